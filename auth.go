@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// endpoint groups with their own credentials
+const (
+	authAPI     = "api"
+	authMetrics = "metrics"
+)
+
+// authConfig is the credentials accepted by each group of endpoints, a group
+// without any credentials is open to everyone
+type authConfig struct {
+	// /read, /write and /-/reload
+	API endpointAuthConfig `yaml:"api"`
+	// /metrics and /debug/pprof/
+	Metrics endpointAuthConfig `yaml:"metrics"`
+}
+
+type endpointAuthConfig struct {
+	// bcrypt hashes of the basic auth passwords by user name
+	BasicAuthUsers map[string]string `yaml:"basicAuthUsers,omitempty"`
+	BearerTokens   []string          `yaml:"bearerTokens,omitempty"`
+}
+
+// authenticator checks the credentials of requests to an endpoint group
+type authenticator struct {
+	users  map[string][]byte
+	tokens [][]byte
+	// hash the passwords of unknown users are checked against, so they take
+	// as long to reject as wrong passwords and don't give away which users exist
+	dummyHash []byte
+
+	// bcrypt is slow on purpose, so credentials are only checked against
+	// their hash the first time
+	mtx      sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func newAuthenticator(c endpointAuthConfig) (*authenticator, error) {
+	a := &authenticator{
+		users:    make(map[string][]byte, len(c.BasicAuthUsers)),
+		verified: map[[sha256.Size]byte]bool{},
+	}
+
+	for user, hash := range c.BasicAuthUsers {
+		if user == "" || strings.Contains(user, ":") {
+			return nil, fmt.Errorf("invalid basic auth user name %q", user)
+		}
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for basic auth user %s: %s", user, err)
+		}
+		a.users[user] = []byte(hash)
+		a.dummyHash = a.users[user]
+	}
+
+	for _, token := range c.BearerTokens {
+		if token == "" {
+			return nil, fmt.Errorf("bearer tokens must not be empty")
+		}
+		a.tokens = append(a.tokens, []byte(token))
+	}
+
+	return a, nil
+}
+
+// open returns whether requests don't need any credentials
+func (a *authenticator) open() bool {
+	return len(a.users) == 0 && len(a.tokens) == 0
+}
+
+// check returns why the credentials of r aren't accepted, or "" if they are
+func (a *authenticator) check(r *http.Request) string {
+	if a.open() {
+		return ""
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		if a.checkUser(user, password) {
+			return ""
+		}
+		return "invalid_basic_auth"
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		if a.checkToken([]byte(strings.TrimPrefix(header, "Bearer "))) {
+			return ""
+		}
+		return "invalid_bearer_token"
+	}
+
+	return "missing_credentials"
+}
+
+func (a *authenticator) checkUser(user, password string) bool {
+	hash, exists := a.users[user]
+	if !exists {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + ":" + password))
+	a.mtx.Lock()
+	verified := a.verified[key]
+	a.mtx.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	a.mtx.Lock()
+	a.verified[key] = true
+	a.mtx.Unlock()
+	return true
+}
+
+func (a *authenticator) checkToken(token []byte) bool {
+	valid := false
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t, token) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// endpointAuthGroup returns the endpoint group a path belongs to, or "" if it
+// doesn't need credentials
+func endpointAuthGroup(p string) string {
+	p = path.Clean("/" + p)
+	switch {
+	case p == "/read" || p == "/write" || p == "/-/reload":
+		return authAPI
+	case p == "/metrics" || p == "/debug/pprof" || strings.HasPrefix(p, "/debug/pprof/"):
+		return authMetrics
+	}
+	return ""
+}
+
+// authenticate rejects requests without valid credentials for the endpoint
+// group of their path before handing them to next
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := endpointAuthGroup(r.URL.Path)
+		if group == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		a := currentSettings().auth[group]
+		reason := a.check(r)
+		if reason != "" {
+			authFailures.WithLabelValues(group, reason).Inc()
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="monetdb-adapter"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEndpointAuthGroup(t *testing.T) {
+	tcs := map[string]string{
+		"/write":              authAPI,
+		"/read":               authAPI,
+		"//read":              authAPI,
+		"/metrics":            authMetrics,
+		"/debug/pprof/":       authMetrics,
+		"/debug/pprof/heap":   authMetrics,
+		"/debug/../metrics":   authMetrics,
+		"/-/ready":            "",
+		"/-/healthy":          "",
+		"/-/reload":           authAPI,
+		"/debug/pprofile":     "",
+		"/write/../-/healthy": "",
+	}
+	for p, e := range tcs {
+		if group := endpointAuthGroup(p); group != e {
+			t.Errorf("Invalid group for %s: %q, expected: %q", p, group, e)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer settings.Store(currentSettings())
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	c.Auth.API.BasicAuthUsers = map[string]string{"prometheus": string(hash)}
+	c.Auth.API.BearerTokens = []string{"t0k3n"}
+	s, err := newRuntimeSettings(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(s)
+
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tcs := []struct {
+		path   string
+		user   string
+		pass   string
+		token  string
+		status int
+		reason string
+	}{
+		{path: "/write", status: http.StatusUnauthorized, reason: "missing_credentials"},
+		{path: "/write", user: "prometheus", pass: "secret", status: http.StatusOK},
+		// the second time the credentials come from the cache
+		{path: "/write", user: "prometheus", pass: "secret", status: http.StatusOK},
+		{path: "/read", user: "prometheus", pass: "wrong", status: http.StatusUnauthorized, reason: "invalid_basic_auth"},
+		{path: "/read", user: "grafana", pass: "secret", status: http.StatusUnauthorized, reason: "invalid_basic_auth"},
+		{path: "/read", token: "t0k3n", status: http.StatusOK},
+		{path: "/read", token: "t0k3", status: http.StatusUnauthorized, reason: "invalid_bearer_token"},
+		// the metrics group has no credentials
+		{path: "/metrics", status: http.StatusOK},
+		{path: "/-/ready", status: http.StatusOK},
+	}
+
+	for _, tc := range tcs {
+		r := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.pass)
+		}
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		var failures float64
+		if tc.reason != "" {
+			failures = testutil.ToFloat64(authFailures.WithLabelValues(authAPI, tc.reason))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("Invalid status for %s as %q with token %q: %d, expected: %d", tc.path, tc.user, tc.token, w.Code, tc.status)
+		}
+
+		if tc.reason != "" {
+			if v := testutil.ToFloat64(authFailures.WithLabelValues(authAPI, tc.reason)); v != failures+1 {
+				t.Errorf("Invalid %s failure count: %v, expected: %v", tc.reason, v, failures+1)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Missing WWW-Authenticate header for %s", tc.path)
+			}
+		}
+	}
+}
+
+func TestListenerMuxes(t *testing.T) {
+	apiMux := http.NewServeMux()
+	initRead(apiMux, nil)
+	metricsMux := newMetricsMux()
+
+	tcs := []struct {
+		mux    *http.ServeMux
+		path   string
+		status int
+	}{
+		{metricsMux, "/metrics", http.StatusOK},
+		{metricsMux, "/debug/pprof/", http.StatusOK},
+		{metricsMux, "/read", http.StatusNotFound},
+		{apiMux, "/metrics", http.StatusNotFound},
+		{apiMux, "/debug/pprof/", http.StatusNotFound},
+	}
+	for _, tc := range tcs {
+		w := httptest.NewRecorder()
+		tc.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("Invalid status for %s: %d, expected: %d", tc.path, w.Code, tc.status)
+		}
+	}
+}
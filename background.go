@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// background runs the adapter's long-running goroutines, so they can all be
+// stopped on shutdown.
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel}
+}
+
+// run runs fn in a goroutine, fn has to return once ctx is done
+func (b *background) run(fn func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		fn(b.ctx)
+	}()
+}
+
+// every calls fn every interval until the background is stopped
+func (b *background) every(interval time.Duration, fn func(now time.Time)) {
+	b.run(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				fn(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// stop tells every goroutine to stop and waits for them to return, or for
+// ctx to be done
+func (b *background) stop(ctx context.Context) error {
+	b.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
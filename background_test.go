@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackgroundStop(t *testing.T) {
+	bg := newBackground()
+
+	ticks := make(chan time.Time, 100)
+	bg.every(time.Millisecond, func(now time.Time) {
+		ticks <- now
+	})
+	<-ticks
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := bg.stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing runs once stopped
+	for len(ticks) > 0 {
+		<-ticks
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(ticks) != 0 {
+		t.Errorf("Goroutine still running after stop")
+	}
+}
+
+func TestBackgroundStopTimeout(t *testing.T) {
+	bg := newBackground()
+
+	release := make(chan struct{})
+	defer close(release)
+	bg.run(func(ctx context.Context) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := bg.stop(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Invalid error: %v, expected: %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// maximum number of samples in a chunk, the same as Prometheus uses
+const maxChunkSamples = 120
+
+// bstream is a stream of bits that is written to the end of a byte slice.
+type bstream struct {
+	stream []byte
+	// number of bits still available in the last byte
+	count uint8
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	// fill up the last byte and put the rest in a new one
+	i := len(b.stream) - 1
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, 0)
+	b.stream[i+1] = byt << b.count
+}
+
+// writeBits writes the nbits lowest bits of u
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= uint(64 - nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+// xorChunk encodes samples with the Gorilla XOR encoding in the format of the
+// Prometheus XOR chunks, which remote read clients decode with chunkenc.
+type xorChunk struct {
+	b   bstream
+	num uint16
+
+	minTime int64
+	maxTime int64
+
+	t      int64
+	v      float64
+	tDelta uint64
+
+	leading  uint8
+	trailing uint8
+}
+
+func newXORChunk() *xorChunk {
+	// the chunk starts with the number of samples
+	return &xorChunk{
+		b:       bstream{stream: make([]byte, 2, 128)},
+		leading: 0xff,
+	}
+}
+
+func (c *xorChunk) bytes() []byte {
+	return c.b.stream
+}
+
+func (c *xorChunk) numSamples() int {
+	return int(c.num)
+}
+
+func (c *xorChunk) append(t int64, v float64) {
+	var tDelta uint64
+
+	switch c.num {
+	case 0:
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+		c.minTime = t
+
+	case 1:
+		tDelta = uint64(t - c.t)
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeVDelta(v)
+
+	default:
+		tDelta = uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+
+		// Prometheus has millisecond timestamps, so it uses bigger buckets than Gorilla
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0x02, 2) // '10'
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0x06, 3) // '110'
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0x0e, 4) // '1110'
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0x0f, 4) // '1111'
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeVDelta(v)
+	}
+
+	c.t = t
+	c.v = v
+	c.tDelta = tDelta
+	c.maxTime = t
+	c.num++
+	binary.BigEndian.PutUint16(c.b.stream, c.num)
+}
+
+// bitRange is true if x fits in nbits with the asymmetric range Prometheus decodes
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (c *xorChunk) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(c.v)
+
+	if vDelta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+
+	// clamp the number of leading zeros so it fits in 5 bits
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// the meaningful bits fit in the window of the previous value
+		c.b.writeBit(false)
+		c.b.writeBits(vDelta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+
+	// 64 significant bits don't fit in 6 bits and are written as 0, which is
+	// never a valid number of significant bits otherwise
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(vDelta>>trailing, int(sigbits))
+}
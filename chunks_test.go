@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// bitReader reads the bits written by a bstream
+type bitReader struct {
+	stream []byte
+	pos    uint
+}
+
+func (r *bitReader) readBits(nbits int) uint64 {
+	var u uint64
+	for i := 0; i < nbits; i++ {
+		bit := (r.stream[r.pos/8] >> (7 - r.pos%8)) & 1
+		u = u<<1 | uint64(bit)
+		r.pos++
+	}
+	return u
+}
+
+func (r *bitReader) readByte() byte {
+	return byte(r.readBits(8))
+}
+
+type xorSample struct {
+	t int64
+	v float64
+}
+
+// decodeXOR decodes a chunk the way the Prometheus chunkenc XOR iterator does
+func decodeXOR(t *testing.T, chunk []byte) []xorSample {
+	num := int(binary.BigEndian.Uint16(chunk))
+	r := &bitReader{stream: chunk[2:]}
+	samples := []xorSample{}
+
+	var (
+		ts       int64
+		v        float64
+		tDelta   uint64
+		leading  uint8
+		trailing uint8
+	)
+
+	readVarint := func(signed bool) uint64 {
+		buf := []byte{}
+		for {
+			b := r.readByte()
+			buf = append(buf, b)
+			if b < 0x80 {
+				break
+			}
+		}
+		if signed {
+			x, _ := binary.Varint(buf)
+			return uint64(x)
+		}
+		x, _ := binary.Uvarint(buf)
+		return x
+	}
+
+	readValue := func() {
+		if r.readBits(1) == 0 {
+			return
+		}
+		if r.readBits(1) == 1 {
+			leading = uint8(r.readBits(5))
+			sigbits := uint8(r.readBits(6))
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			trailing = 64 - leading - sigbits
+		}
+		sigbits := 64 - leading - trailing
+		bits := r.readBits(int(sigbits))
+		v = math.Float64frombits(math.Float64bits(v) ^ (bits << trailing))
+	}
+
+	for i := 0; i < num; i++ {
+		switch i {
+		case 0:
+			ts = int64(readVarint(true))
+			v = math.Float64frombits(r.readBits(64))
+		case 1:
+			tDelta = readVarint(false)
+			ts += int64(tDelta)
+			readValue()
+		default:
+			var d byte
+			for j := 0; j < 4; j++ {
+				d <<= 1
+				if r.readBits(1) == 0 {
+					break
+				}
+				d |= 1
+			}
+
+			var sz int
+			switch d {
+			case 0x02:
+				sz = 14
+			case 0x06:
+				sz = 17
+			case 0x0e:
+				sz = 20
+			case 0x0f:
+				sz = 64
+			}
+
+			var dod int64
+			if sz != 0 {
+				bits := r.readBits(sz)
+				if sz != 64 && bits > (1<<uint(sz-1)) {
+					bits = bits - (1 << uint(sz))
+				}
+				dod = int64(bits)
+			}
+			tDelta = uint64(int64(tDelta) + dod)
+			ts += int64(tDelta)
+			readValue()
+		}
+		samples = append(samples, xorSample{ts, v})
+	}
+
+	if int(r.pos+7)/8 > len(chunk)-2 {
+		t.Errorf("Decoder read past the end of the chunk")
+	}
+	return samples
+}
+
+func TestXORChunk(t *testing.T) {
+	samples := []xorSample{
+		{1000, 1},
+		{16000, 1},
+		{31000, 2.5},
+		{46000, 2.5},
+		{61001, -3},
+		{76000, 1e300},
+		{76001, 0},
+		{80000, 0.1},
+		{200000, 0.2},
+		{5000000, math.Inf(1)},
+		{5000001, 42},
+		{1 << 40, 43},
+	}
+
+	c := newXORChunk()
+	for _, s := range samples {
+		c.append(s.t, s.v)
+	}
+
+	if c.numSamples() != len(samples) {
+		t.Errorf("Invalid number of samples: %d, expected: %d", c.numSamples(), len(samples))
+	}
+	if c.minTime != 1000 || c.maxTime != 1<<40 {
+		t.Errorf("Invalid time range: %d - %d", c.minTime, c.maxTime)
+	}
+
+	decoded := decodeXOR(t, c.bytes())
+	if len(decoded) != len(samples) {
+		t.Fatalf("Invalid number of decoded samples: %d, expected: %d", len(decoded), len(samples))
+	}
+	for i, s := range samples {
+		if decoded[i] != s {
+			t.Errorf("Invalid sample %d: %v, expected: %v", i, decoded[i], s)
+		}
+	}
+}
+
+func TestXORChunkSingleSample(t *testing.T) {
+	c := newXORChunk()
+	c.append(1000, 1)
+
+	// sample count, varint timestamp, float bits
+	e := []byte{0x00, 0x01, 0xd0, 0x0f, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}
+	if string(c.bytes()[:len(e)]) != string(e) {
+		t.Errorf("Invalid chunk: %x, expected: %x", c.bytes(), e)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "monetdb-adapter-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := loadConfig("adapter", nil, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := defaultConfig()
+	if !reflect.DeepEqual(c, e) {
+		t.Errorf("Invalid config: %+v, expected: %+v", c, e)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  url: a:b@file:50000/db
+  maxOpenConns: 20
+listen:
+  address: ":9201"
+whitelist: [up, node_load1]
+write:
+  batchSize: 100
+  flushInterval: 10s
+read:
+  timeout: 30s
+retention:
+  retention: 720h
+  overrides:
+    up: 24h
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	env := map[string]string{
+		"MONETDB_ADAPTER_CONFIG":            path,
+		"MONETDB_ADAPTER_WRITE_BATCH_SIZE":  "200",
+		"MONETDB_ADAPTER_READ_TIMEOUT":      "45s",
+		"MONETDB_ADAPTER_DB_MAX_OPEN_CONNS": "30",
+	}
+	args := []string{"-writeBatchSize", "300", "-whitelist", "up,node_cpu"}
+
+	c, err := loadConfig("adapter", args, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"file", c.file, path},
+		{"db url from file", c.DB.URL, "a:b@file:50000/db"},
+		{"listen address from file", c.Listen.Address, ":9201"},
+		{"metrics address default", c.Listen.MetricsAddress, ":8080"},
+		{"flush interval from file", c.Write.FlushInterval, 10 * time.Second},
+		{"max open conns from env", c.DB.MaxOpenConns, 30},
+		{"read timeout from env", c.Read.Timeout, 45 * time.Second},
+		{"batch size from flag", c.Write.BatchSize, 300},
+		{"whitelist from flag", c.Whitelist, []string{"up", "node_cpu"}},
+		{"retention from file", c.Retention.Retention, 720 * time.Hour},
+		{"overrides from file", c.Retention.Overrides, map[string]time.Duration{"up": 24 * time.Hour}},
+	}
+	for _, tc := range tcs {
+		if !reflect.DeepEqual(tc.value, tc.expected) {
+			t.Errorf("Invalid %s: %v, expected: %v", tc.name, tc.value, tc.expected)
+		}
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tcs := []struct {
+		file string
+		env  map[string]string
+		args []string
+	}{
+		{file: "write:\n  batchSize: 0\n"},
+		{file: "write:\n  batchSize: 100\n  queueSize: 10\n"},
+		{file: "unknown: true\n"},
+		{file: "db:\n  storageLayout: narrow\n"},
+		{file: "retention:\n  overrides:\n    up: -1h\n"},
+		{file: "auth:\n  api:\n    basicAuthUsers:\n      prometheus: secret\n"},
+		{file: "auth:\n  metrics:\n    bearerTokens: ['']\n"},
+		{env: map[string]string{"MONETDB_ADAPTER_READ_PARALLELISM": "many"}},
+		{args: []string{"-partitionInterval", "1500us"}},
+		{args: []string{"-listenAddress", ""}},
+		{args: []string{"-retentionOverrides", "up"}},
+	}
+
+	for _, tc := range tcs {
+		env := map[string]string{}
+		for k, v := range tc.env {
+			env[k] = v
+		}
+		if tc.file != "" {
+			path := writeConfigFile(t, tc.file)
+			defer os.RemoveAll(filepath.Dir(path))
+			env["MONETDB_ADAPTER_CONFIG"] = path
+		}
+
+		_, err := loadConfig("adapter", tc.args, func(k string) string { return env[k] })
+		if err == nil {
+			t.Errorf("Expected an error for file %q, env %v and args %v", tc.file, tc.env, tc.args)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tcs := map[string]string{
+		"dbURL":                "MONETDB_ADAPTER_DB_URL",
+		"writeBatchSize":       "MONETDB_ADAPTER_WRITE_BATCH_SIZE",
+		"metricsListenAddress": "MONETDB_ADAPTER_METRICS_LISTEN_ADDRESS",
+		"print-config":         "MONETDB_ADAPTER_PRINT_CONFIG",
+	}
+	for name, e := range tcs {
+		if env := envName(name); env != e {
+			t.Errorf("Invalid env name for %s: %s, expected: %s", name, env, e)
+		}
+	}
+}
+
+func TestMarshalConfig(t *testing.T) {
+	c := defaultConfig()
+	c.DB.URL = "monetdb:s3cr3t@monetdb:50000/db"
+	c.Auth.API.BearerTokens = []string{"t0k3n"}
+
+	out, err := c.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "s3cr3t") || strings.Contains(string(out), "t0k3n") {
+		t.Errorf("Secret in printed config: %s", out)
+	}
+
+	// the printed config can be loaded again
+	parsed := &config{}
+	err = yaml.UnmarshalStrict(out, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Write.FlushInterval != c.Write.FlushInterval || parsed.DB.URL != "monetdb:<secret>@monetdb:50000/db" {
+		t.Errorf("Invalid printed config: %s", out)
+	}
+
+	for url, e := range map[string]string{
+		"monetdb://me:p@ss@host/db": "monetdb://me:<secret>@host/db",
+		"me@host/db":                "me@host/db",
+		"host:50000/db":             "host:50000/db",
+	} {
+		if r := redactURL(url); r != e {
+			t.Errorf("Invalid redacted url for %s: %s, expected: %s", url, r, e)
+		}
+	}
+}
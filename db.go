@@ -1,57 +1,112 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//_ "github.com/fajran/go-monetdb"
-	_ "github.internal.digitalocean.com/observability/monet/driver"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
 
 	"github.com/pkg/errors"
-	"github.com/prometheus/common/model"
 )
 
 var tableCreateLock sync.Mutex
 
-var labelsMap = map[string]string{}
+// labelsMap holds the comma separated label columns of each metric table. It's
+// replaced as a whole on refresh, so it's read through currentLabelsMap
+// without locking.
+var labelsMap atomic.Value
+
+// labelsMapLock serializes refreshes of the labelsMap
 var labelsMapLock sync.Mutex
 
-var metricWhitelist = map[string]bool{}
+// when the labelsMap was last loaded from the meta table in unix nanoseconds,
+// read atomically so readiness checks don't wait on a refresh
+var labelsRefreshed int64
+
+// how long loading the meta table during a refresh may take
+var labelsRefreshTimeout = 10 * time.Second
+
+func init() {
+	labelsMap.Store(map[string]string{})
+}
+
+// currentLabelsMap returns the labels of the metric tables as of the last refresh
+func currentLabelsMap() map[string]string {
+	return labelsMap.Load().(map[string]string)
+}
+
+// labelsRefreshedAt returns when the labelsMap was last loaded, the zero time if never
+func labelsRefreshedAt() time.Time {
+	nanos := atomic.LoadInt64(&labelsRefreshed)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// how often the labelsMap is refreshed, in case another adapter changed the meta table
+var labelsRefreshInterval = 30 * time.Second
 
 // meta table
 var metaTableName string = "prometheus_adapter_meta"
 
 var createMetaTableQuery string = `
-CREATE TABLE "prometheus_adapter_meta" ("metric" VARCHAR(120), "labels" VARCHAR(120));`
+CREATE TABLE "prometheus_adapter_meta" ("metric" VARCHAR(120), "labels" CLOB);`
+
+var selectColumnTypeQuery string = `
+SELECT columns.type FROM sys.columns, sys.tables WHERE columns.table_id = tables.id AND tables.name = ? AND columns.name = ?;`
+
+// older meta tables kept the labels in a VARCHAR(120), which metrics outgrow
+// as they gain labels, so they're copied into a table with a CLOB column
+var migrateMetaTableQueries = []string{
+	`CREATE TABLE "prometheus_adapter_meta_old" AS SELECT "metric", "labels" FROM "prometheus_adapter_meta" WITH DATA;`,
+	`DROP TABLE "prometheus_adapter_meta";`,
+	createMetaTableQuery,
+	`INSERT INTO "prometheus_adapter_meta" SELECT "metric", "labels" FROM "prometheus_adapter_meta_old";`,
+	`DROP TABLE "prometheus_adapter_meta_old";`,
+}
 
 var insertMetaTableQuery string = `
-INSERT INTO prometheus_adapter_meta VALUES ('%s', '%s');`
+INSERT INTO prometheus_adapter_meta VALUES (?, ?);`
 
 var selectMetaTableQuery string = `
-SELECT labels FROM prometheus_adapter_meta WHERE metric = '%s';`
+SELECT labels FROM prometheus_adapter_meta WHERE metric = ?;`
 
 var selectAllMetaTableQuery string = `
 SELECT metric, labels FROM prometheus_adapter_meta;`
 
+var updateMetaTableQuery string = `
+UPDATE prometheus_adapter_meta SET labels = ? WHERE metric = ?;`
+
 // metric tables
 var createTableQuery string = `
-CREATE TABLE "%s" ("timestamp" BIGINT, "value" FLOAT%s);`
+CREATE TABLE %s (%s);`
+
+var createMergeTableQuery string = `
+CREATE MERGE TABLE %s (%s) PARTITION BY RANGE ON ("timestamp");`
 
-//var insertMetricQuery string = `
-//INSERT INTO "%s" VALUES (?, ?%s);`
-var insertMetricQuery string = `INSERT INTO "%s" VALUES (%s);`
+var addColumnQuery string = `
+ALTER TABLE %s ADD COLUMN %s VARCHAR(120) DEFAULT NULL;`
 
 // find all tables
 var listTablesQuery string = `
 SELECT name FROM sys.tables WHERE tables.system=false;`
 
-func initDB(dbURL string, whitelist string) (*sql.DB, error) {
+func initDB(conf *dbConfig) (*sql.DB, error) {
+	if !validLayout(conf.StorageLayout) {
+		return nil, fmt.Errorf("unknown storage layout %q", conf.StorageLayout)
+	}
+	storageLayout = conf.StorageLayout
+
 	// connect to database
-	db, err := sql.Open("monetdb", dbURL)
+	db, err := sql.Open("monetdb", conf.URL)
 	if err != nil {
 		return nil, errors.Wrap(err, "open DB")
 	}
@@ -72,6 +127,19 @@ func initDB(dbURL string, whitelist string) (*sql.DB, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "create meta table")
 		}
+	} else {
+		err = migrateMetaTable(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "migrate meta table")
+		}
+	}
+
+	// the series layout keeps label sets in their own table
+	if storageLayout == layoutSeries {
+		err = initSeries(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "init series")
+		}
 	}
 
 	// init labelsMap
@@ -80,36 +148,39 @@ func initDB(dbURL string, whitelist string) (*sql.DB, error) {
 		return nil, errors.Wrap(err, "refresh labels map")
 	}
 
-	// keep the labelsMap up to date
-	ticker := time.NewTicker(30 * time.Second)
-	go func() {
-		for _ = range ticker.C {
-			refreshLabelsMap(db)
+	return db, nil
+}
+
+// startDBRefresh keeps the labelsMap and connection stats up to date
+func startDBRefresh(bg *background, db *sql.DB) {
+	bg.every(labelsRefreshInterval, func(time.Time) {
+		err := refreshLabelsMap(db)
+		if err != nil {
+			log.Printf("error refreshing labels map: %s", err)
 		}
-	}()
+	})
 
-	// init static Metric whitelist
-	for _, name := range strings.Split(whitelist, ",") {
-		metricWhitelist[name] = true
-	}
+	bg.every(5*time.Second, func(time.Time) {
+		stats := db.Stats()
+		openConns.Set(float64(stats.OpenConnections))
+	})
+}
 
-	// db.SetConnMaxLifetime(30 * time.Second)
-	// db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(1000)
+func tableExists(db *sql.DB, name string) (bool, error) {
+	tables, err := listTables(db)
+	if err != nil {
+		return false, err
+	}
 
-	// keep the labelsMap up to date
-	ticker2 := time.NewTicker(5 * time.Second)
-	go func() {
-		for _ = range ticker2.C {
-			stats := db.Stats()
-			openConns.Set(float64(stats.OpenConnections))
+	for _, tableName := range tables {
+		if tableName == name {
+			return true, nil
 		}
-	}()
-
-	return db, nil
+	}
+	return false, nil
 }
 
-func tableExists(db *sql.DB, name string) (bool, error) {
+func listTables(db *sql.DB) ([]string, error) {
 	tableCreateLock.Lock()
 	defer tableCreateLock.Unlock()
 
@@ -118,31 +189,28 @@ func tableExists(db *sql.DB, name string) (bool, error) {
 	dbQueries.Inc()
 	if err != nil {
 		queryErrors.Inc()
-		return false, errors.Wrap(err, "list tables query")
+		return nil, errors.Wrap(err, "list tables query")
 	}
 	defer rows.Close()
 
-	var rowCounter float64
+	tables := []string{}
 	for rows.Next() {
-		rowCounter++
 		err := rows.Scan(&tableName)
 		if err != nil {
 			rowScanErrors.Inc()
-			return false, errors.Wrap(err, "scan list tables rows")
-		}
-		if tableName == name {
-			return true, nil
+			return nil, errors.Wrap(err, "scan list tables rows")
 		}
+		tables = append(tables, tableName)
 	}
 
-	rowsRead.Add(rowCounter)
+	rowsRead.Add(float64(len(tables)))
 	err = rows.Err()
 	if err != nil {
 		rowErrors.Inc()
-		return false, errors.Wrap(err, "list tables rows")
+		return nil, errors.Wrap(err, "list tables rows")
 	}
 
-	return false, nil
+	return tables, nil
 }
 
 func createMetaTable(db *sql.DB) error {
@@ -160,20 +228,72 @@ func createMetaTable(db *sql.DB) error {
 	return nil
 }
 
+// migrateMetaTable makes the labels column of a meta table created by an
+// older version a CLOB
+func migrateMetaTable(db *sql.DB) error {
+	tableCreateLock.Lock()
+	defer tableCreateLock.Unlock()
+
+	var columnType string
+	err := db.QueryRow(selectColumnTypeQuery, metaTableName, "labels").Scan(&columnType)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "select labels column type")
+	}
+	if strings.ToLower(columnType) == "clob" {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+
+	for _, query := range migrateMetaTableQueries {
+		_, err = tx.Exec(query)
+		if err != nil {
+			tx.Rollback()
+			queryErrors.Inc()
+			return errors.Wrap(err, "copy meta table")
+		}
+	}
+
+	err = tx.Commit()
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transaction")
+	}
+	log.Printf("changed the labels column of the meta table from %s to clob", columnType)
+
+	return nil
+}
+
 func createMetricTable(db *sql.DB, name string, labels []string) error {
 	tableCreateLock.Lock()
 	defer tableCreateLock.Unlock()
 
-	var fields strings.Builder
+	// another writer may have created the table while we waited on the lock
+	if _, exists := currentLabelsMap()[name]; exists {
+		return nil
+	}
 
-	for _, label := range labels {
-		fields.WriteString(fmt.Sprintf(",\"%s\" VARCHAR(120)", label))
+	// labels live in the series table in the series layout
+	if storageLayout == layoutSeries {
+		labels = []string{}
 	}
 
+	// partitioned metrics are merge tables, partitions are created as samples arrive
+	tableQuery := createTableQuery
+	if partitionInterval > 0 {
+		tableQuery = createMergeTableQuery
+	}
+	query := fmt.Sprintf(tableQuery, monetdb.QuoteIdentifier(name), metricTableColumns(labels))
+
 	// TODO Transaction this
 
 	// create table
-	query := fmt.Sprintf(createTableQuery, name, fields.String())
 	_, err := db.Exec(query)
 	dbQueries.Inc()
 	if err != nil {
@@ -184,8 +304,7 @@ func createMetricTable(db *sql.DB, name string, labels []string) error {
 	log.Printf("created table %s", name)
 
 	// create meta table entry
-	query = fmt.Sprintf(insertMetaTableQuery, name, strings.Join(labels, ","))
-	_, err = db.Exec(query)
+	_, err = db.Exec(insertMetaTableQuery, name, strings.Join(labels, ","))
 	dbQueries.Inc()
 	if err != nil {
 		queryErrors.Inc()
@@ -203,6 +322,20 @@ func createMetricTable(db *sql.DB, name string, labels []string) error {
 	return nil
 }
 
+// metricTableColumns returns the column definitions of a metric table with the given labels
+func metricTableColumns(labels []string) string {
+	if storageLayout == layoutSeries {
+		return seriesMetricTableColumns
+	}
+
+	var fields strings.Builder
+	fields.WriteString(`"timestamp" BIGINT, "value" FLOAT`)
+	for _, label := range labels {
+		fields.WriteString(fmt.Sprintf(", %s VARCHAR(120)", monetdb.QuoteIdentifier(label)))
+	}
+	return fields.String()
+}
+
 // labelsMap functions
 
 func refreshLabelsMap(db *sql.DB) error {
@@ -216,10 +349,14 @@ func refreshLabelsMap(db *sql.DB) error {
 
 	newMap := map[string]string{}
 
-	rows, err := db.Query(selectAllMetaTableQuery)
+	ctx, cancel := context.WithTimeout(context.Background(), labelsRefreshTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, selectAllMetaTableQuery)
 	dbQueries.Inc()
 	if err != nil {
 		queryErrors.Inc()
+		labelsRefreshFailures.WithLabelValues("query").Inc()
 		return errors.Wrap(err, "select all meta table query")
 	}
 	defer rows.Close()
@@ -228,6 +365,7 @@ func refreshLabelsMap(db *sql.DB) error {
 		err = rows.Scan(&metric, &labels)
 		if err != nil {
 			rowScanErrors.Inc()
+			labelsRefreshFailures.WithLabelValues("scan").Inc()
 			return errors.Wrap(err, "scan meta table rows")
 		}
 		newMap[metric] = labels
@@ -237,36 +375,156 @@ func refreshLabelsMap(db *sql.DB) error {
 	err = rows.Err()
 	if err != nil {
 		rowErrors.Inc()
+		labelsRefreshFailures.WithLabelValues("row").Inc()
 		return errors.Wrap(err, "meta table row")
 	}
 
-	labelsMap = newMap
+	labelsMap.Store(newMap)
+	atomic.StoreInt64(&labelsRefreshed, time.Now().UnixNano())
+	labelsRefreshSeconds.SetToCurrentTime()
 	return nil
 }
 
-func getLabelsOrCreate(db *sql.DB, name string, metric model.Metric) ([]string, error) {
-	labelStr, exists := labelsMap[name]
+// getLabelsOrCreate returns the label columns of a metric table, creating the
+// table or adding columns to it so that it can hold all of the given labels.
+func getLabelsOrCreate(db *sql.DB, name string, labels []string) ([]string, error) {
+	labelStr, exists := currentLabelsMap()[name]
 	if !exists {
-		labels := make([]string, 0, len(metric)-1)
-		for k := range metric {
-			if string(k) != model.MetricNameLabel {
-				labels = append(labels, string(k))
-			}
-		}
 		err := createMetricTable(db, name, labels)
 		if err != nil {
 			return nil, err
 		}
-		labelStr, _ = labelsMap[name]
+		labelStr, _ = currentLabelsMap()[name]
+	}
+
+	if len(missingLabels(splitLabels(labelStr), labels)) > 0 {
+		err := addMetricLabels(db, name, labels)
+		if err != nil {
+			return nil, err
+		}
+		labelStr, _ = currentLabelsMap()[name]
+	}
+
+	return splitLabels(labelStr), nil
+}
+
+// addMetricLabels adds a column to a metric table for each of the labels it
+// doesn't have yet. Existing rows get NULL for the new columns.
+func addMetricLabels(db *sql.DB, name string, labels []string) error {
+	// partitions mustn't come and go while their columns change
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	tableCreateLock.Lock()
+	defer tableCreateLock.Unlock()
+
+	// another writer may have added the columns while we waited on the lock
+	current := splitLabels(currentLabelsMap()[name])
+	missing := missingLabels(current, labels)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	partitions := []partition{}
+	if partitionInterval > 0 {
+		var err error
+		partitions, err = metricPartitions(db, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+
+	for _, query := range addLabelsQueries(name, partitions, missing) {
+		_, err = tx.Exec(query)
+		if err != nil {
+			tx.Rollback()
+			queryErrors.Inc()
+			return errors.Wrap(err, "add columns to metric table")
+		}
 	}
 
-	return strings.Split(labelStr, ","), nil
+	// the meta table entry and the columns change together
+	_, err = tx.Exec(updateMetaTableQuery, strings.Join(append(current, missing...), ","), name)
+	if err != nil {
+		tx.Rollback()
+		queryErrors.Inc()
+		return errors.Wrap(err, "update meta table entry")
+	}
+
+	err = tx.Commit()
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transaction")
+	}
+	log.Printf("added labels %s to table %s", strings.Join(missing, ","), name)
+
+	// new columns means we need to refresh the labels cache
+	err = refreshLabelsMap(db)
+	if err != nil {
+		return errors.Wrap(err, "refresh labels map")
+	}
+
+	return nil
+}
+
+// addLabelsQueries returns the queries adding columns for labels to a metric
+// table. A merge table and its partitions need the same columns, so the
+// partitions are detached, get the columns as well and are attached again.
+func addLabelsQueries(name string, partitions []partition, labels []string) []string {
+	queries := []string{}
+	for _, p := range partitions {
+		queries = append(queries, fmt.Sprintf(detachPartitionQuery, monetdb.QuoteIdentifier(name), monetdb.QuoteIdentifier(p.table)))
+	}
+
+	tables := []string{name}
+	for _, p := range partitions {
+		tables = append(tables, p.table)
+	}
+	for _, table := range tables {
+		for _, label := range labels {
+			queries = append(queries, fmt.Sprintf(addColumnQuery, monetdb.QuoteIdentifier(table), monetdb.QuoteIdentifier(label)))
+		}
+	}
+
+	for _, p := range partitions {
+		queries = append(queries, fmt.Sprintf(addPartitionQuery, monetdb.QuoteIdentifier(name), monetdb.QuoteIdentifier(p.table), p.start, p.end))
+	}
+	return queries
+}
+
+// missingLabels returns the labels that aren't in existing
+func missingLabels(existing []string, labels []string) []string {
+	has := make(map[string]bool, len(existing))
+	for _, label := range existing {
+		has[label] = true
+	}
+
+	missing := []string{}
+	for _, label := range labels {
+		if !has[label] {
+			missing = append(missing, label)
+		}
+	}
+	return missing
 }
 
 func getLabels(db *sql.DB, name string) ([]string, error) {
-	labelStr, exists := labelsMap[name]
+	labelStr, exists := currentLabelsMap()[name]
 	if !exists {
 		return nil, fmt.Errorf("could not find table for metric %s", name)
 	}
-	return strings.Split(labelStr, ","), nil
+	return splitLabels(labelStr), nil
+}
+
+// splitLabels splits a meta table labels entry, which is empty for metrics without labels
+func splitLabels(labelStr string) []string {
+	if labelStr == "" {
+		return []string{}
+	}
+	return strings.Split(labelStr, ",")
 }
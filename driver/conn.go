@@ -5,6 +5,9 @@
 package monetdb
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
 	"database/sql/driver"
 	"fmt"
 	"strconv"
@@ -18,36 +21,122 @@ type Conn struct {
 
 var c driver.Execer = &Conn{}
 
+var (
+	_ driver.ConnBeginTx        = &Conn{}
+	_ driver.ExecerContext      = &Conn{}
+	_ driver.QueryerContext     = &Conn{}
+	_ driver.ConnPrepareContext = &Conn{}
+	_ driver.SessionResetter    = &Conn{}
+)
+
 func newConn(c config) (*Conn, error) {
 	conn := &Conn{
 		config: c,
 		mapi:   nil,
 	}
 
-	m := NewMapi(c.Hostname, c.Port, c.Username, c.Password, c.Database, "sql")
+	m := NewMapi(c.Hostname, c.Port, c.Username, c.Password, c.Database, c.Language)
+	m.UnixSocket = c.Socket
+	m.TLSConfig = c.TLS
+	m.ConnectTimeout = c.ConnectTimeout
+	m.ReadTimeout = c.ReadTimeout
+	m.WriteTimeout = c.WriteTimeout
 	err := m.Connect()
 	if err != nil {
+		m.Disconnect()
 		return conn, err
 	}
 
 	conn.mapi = m
+	err = conn.setupSession()
+	if err != nil {
+		conn.Close()
+		return conn, err
+	}
 	return conn, nil
 }
 
+// setupSession applies the session settings of the DSN
+func (c *Conn) setupSession() error {
+	if c.config.Language != "sql" {
+		return nil
+	}
+
+	// the sizes of columns are only sent on request
+	cmds := []string{"Xsizeheader 1"}
+	if c.config.ReplySize != 0 {
+		cmds = append(cmds, fmt.Sprintf("Xreply_size %d", c.config.ReplySize))
+	}
+	if !c.config.Autocommit {
+		cmds = append(cmds, "Xauto_commit 0")
+	}
+	if c.config.Timezone != "" {
+		cmds = append(cmds, fmt.Sprintf("sSET TIME ZONE INTERVAL '%s' HOUR TO MINUTE;", c.config.Timezone))
+	}
+	if c.config.Schema != "" {
+		cmds = append(cmds, fmt.Sprintf("sSET SCHEMA %s;", QuoteIdentifier(c.config.Schema)))
+	}
+
+	for _, cmd := range cmds {
+		_, err := c.cmd(cmd)
+		if err != nil {
+			return fmt.Errorf("Session setup failed on %s: %s", cmd, err)
+		}
+	}
+	return nil
+}
+
 func (c *Conn) Prepare(query string) (driver.Stmt, error) {
+	if isCopyIn(query) {
+		return newCopyStmt(c, query), nil
+	}
 	return newStmt(c, query), nil
 }
 
+// PrepareContext is Prepare, statements are only sent to MonetDB when
+// they're executed.
+func (c *Conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Prepare(query)
+}
+
 func (c *Conn) Close() error {
-	c.mapi.Disconnect()
+	if c.mapi != nil {
+		c.mapi.Disconnect()
+	}
 	c.mapi = nil
 	return nil
 }
 
+// ResetSession tells database/sql to throw away connections that were
+// closed by an interrupted command.
+func (c *Conn) ResetSession(ctx context.Context) error {
+	if c.mapi == nil || c.mapi.State != MAPI_STATE_READY {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
 func (c *Conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction. MonetDB transactions are always
+// serializable and can't be made read only.
+func (c *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	level := sql.IsolationLevel(opts.Isolation)
+	if level != sql.LevelDefault && level != sql.LevelSerializable {
+		return nil, fmt.Errorf("Unsupported isolation level: %s", level)
+	}
+	if opts.ReadOnly {
+		return nil, fmt.Errorf("Read only transactions are not supported")
+	}
+
 	t := newTx(c)
 
-	_, err := c.execute("START TRANSACTION")
+	_, err := c.executeContext(ctx, "START TRANSACTION")
 	if err != nil {
 		t.err = err
 	}
@@ -56,13 +145,31 @@ func (c *Conn) Begin() (driver.Tx, error) {
 }
 
 func (c *Conn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.exec(context.Background(), query, args)
+}
+
+func (c *Conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.exec(ctx, query, values)
+}
+
+// QueryContext runs a query as an unnamed statement, which is what
+// database/sql would do without it.
+func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return newStmt(c, query).QueryContext(ctx, args)
+}
+
+func (c *Conn) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
 	// don't support interpolating params in non statement Execs
 	if len(args) > 0 {
 		return nil, driver.ErrSkip
 	}
 
 	res := newResult()
-	r, err := c.execute(query)
+	r, err := c.executeContext(ctx, query)
 	if err != nil {
 		res.err = err
 		return res, res.err
@@ -78,16 +185,45 @@ func (c *Conn) Exec(query string, args []driver.Value) (driver.Result, error) {
 }
 
 func (c *Conn) cmd(cmd string) (string, error) {
+	return c.cmdContext(context.Background(), cmd)
+}
+
+func (c *Conn) cmdContext(ctx context.Context, cmd string) (string, error) {
 	if c.mapi == nil {
 		return "", fmt.Errorf("Database connection closed")
 	}
 
-	return c.mapi.Cmd(cmd)
+	return c.mapi.CmdContext(ctx, cmd)
+}
+
+func (c *Conn) cmdStreamContext(ctx context.Context, cmd string, fn func(r *bufio.Reader) error) error {
+	if c.mapi == nil {
+		return fmt.Errorf("Database connection closed")
+	}
+
+	return c.mapi.CmdStreamContext(ctx, cmd, fn)
 }
 
 func (c *Conn) execute(q string) (string, error) {
+	return c.executeContext(context.Background(), q)
+}
+
+func (c *Conn) executeContext(ctx context.Context, q string) (string, error) {
 	cmd := fmt.Sprintf("s%s;", q)
-	return c.cmd(cmd)
+	return c.cmdContext(ctx, cmd)
+}
+
+// namedValues converts the arguments of the context methods, MonetDB only
+// supports positional parameters.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("Named parameters are not supported: %s", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
 }
 
 type queryResults struct {
@@ -133,6 +269,9 @@ func (qr *queryResults) storeResult(r string) error {
 			precisions = make([]int, qr.columnCount)
 			scales = make([]int, qr.columnCount)
 			nullOks = make([]int, qr.columnCount)
+			for i := range nullOks {
+				nullOks[i] = -1
+			}
 
 		} else if strings.HasPrefix(line, mapi_MSG_TUPLE) {
 			v, err := qr.parseTuple(line)
@@ -188,7 +327,7 @@ func (qr *queryResults) storeResult(r string) error {
 						s = append(s, val)
 					}
 					internalSizes[i] = s[0]
-					sizes = append(sizes, s)
+					sizes[i] = s
 				}
 				for j, t := range columnTypes {
 					if t == "decimal" {
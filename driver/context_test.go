@@ -0,0 +1,177 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCmdContextCancel(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	// the server reads the command but never replies
+	received := make(chan struct{})
+	go func() {
+		server.getBlock()
+		close(received)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	_, err := client.CmdContext(ctx, "sSELECT 1;")
+	if err != context.Canceled {
+		t.Errorf("Invalid error: %v, expected: %v", err, context.Canceled)
+	}
+	if client.State != MAPI_STATE_INIT {
+		t.Errorf("Interrupted connection wasn't closed")
+	}
+}
+
+func TestCmdContextDeadline(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	go server.getBlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.CmdContext(ctx, "sSELECT 1;")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Invalid error: %v, expected: %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Command took %s to time out", elapsed)
+	}
+
+	conn := &Conn{mapi: client}
+	if err := conn.ResetSession(context.Background()); err != driver.ErrBadConn {
+		t.Errorf("Invalid session reset error: %v, expected: %v", err, driver.ErrBadConn)
+	}
+}
+
+func TestCmdContextReply(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			server.getBlock()
+			server.putBlock([]byte("&2 1 -1\n"))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	conn := &Conn{mapi: client}
+	stmt := newStmt(conn, "INSERT INTO t VALUES (1)")
+	stmt.execId = 1
+
+	res, err := stmt.ExecContext(ctx, nil)
+	if err != nil {
+		t.Fatalf("Error executing statement: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Errorf("Invalid rows affected: %d, expected: 1", n)
+	}
+
+	// the deadline of the context doesn't outlive the command
+	cancel()
+	if _, err := stmt.Exec(nil); err != nil {
+		t.Fatalf("Error executing statement after the context was done: %v", err)
+	}
+	if err := conn.ResetSession(context.Background()); err != nil {
+		t.Errorf("Invalid session reset error: %v", err)
+	}
+}
+
+func TestBeginTxOptions(t *testing.T) {
+	conn := &Conn{}
+	if _, err := conn.BeginTx(context.Background(), driver.TxOptions{ReadOnly: true}); err == nil {
+		t.Errorf("Expected an error for a read only transaction")
+	}
+	if _, err := conn.ExecContext(context.Background(), "SELECT ?", []driver.NamedValue{{Name: "a", Ordinal: 1, Value: int64(1)}}); err == nil {
+		t.Errorf("Expected an error for a named parameter")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	go server.getBlock()
+
+	client.ReadTimeout = 50 * time.Millisecond
+	_, err := client.CmdContext(context.Background(), "sSELECT 1;")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Invalid error: %v, expected a timeout", err)
+	}
+	if client.State != MAPI_STATE_INIT {
+		t.Errorf("Timed out connection wasn't closed")
+	}
+}
+
+func TestSetupSession(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			b, err := server.getBlock()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(b)
+			server.putBlock([]byte(""))
+		}
+	}()
+
+	conn := &Conn{mapi: client, config: config{
+		Language:   "sql",
+		ReplySize:  1000,
+		Autocommit: false,
+		Timezone:   "+01:00",
+		Schema:     `my"schema`,
+	}}
+	err := conn.setupSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect()
+
+	cmds := []string{}
+	for cmd := range received {
+		cmds = append(cmds, cmd)
+	}
+	e := []string{
+		"Xsizeheader 1",
+		"Xreply_size 1000",
+		"Xauto_commit 0",
+		"sSET TIME ZONE INTERVAL '+01:00' HOUR TO MINUTE;",
+		`sSET SCHEMA "my""schema";`,
+	}
+	if !reflect.DeepEqual(cmds, e) {
+		t.Errorf("Invalid session setup: %q, expected: %q", cmds, e)
+	}
+}
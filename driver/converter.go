@@ -283,6 +283,10 @@ var toMonetMappers = map[string]toMonetConverter{
 func convertToGo(value, dataType string) (driver.Value, error) {
 	if mapper, ok := toGoMappers[dataType]; ok {
 		value := strings.TrimSpace(value)
+		// string values are quoted, so this can't be confused with a value
+		if value == "NULL" {
+			return nil, nil
+		}
 		return mapper(value)
 	}
 	return nil, fmt.Errorf("Type not supported: %s", dataType)
@@ -300,3 +304,68 @@ func convertToMonet(value driver.Value) (string, error) {
 	}
 	return "", fmt.Errorf("Type not supported: %v", t)
 }
+
+func toCopyString(v driver.Value) (string, error) {
+	s := fmt.Sprintf("%v", v)
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return fmt.Sprintf("\"%v\"", s), nil
+}
+
+func toCopyNull(v driver.Value) (string, error) {
+	return "", nil
+}
+
+func toCopyByteString(v driver.Value) (string, error) {
+	switch val := v.(type) {
+	case []uint8:
+		return toCopyString(string(val))
+	default:
+		return "", fmt.Errorf("Unsupported type")
+	}
+}
+
+func toCopyDateTimeString(v driver.Value) (string, error) {
+	switch val := v.(type) {
+	case Time:
+		return toCopyString(val.String())
+	case Date:
+		return toCopyString(val.String())
+	default:
+		return "", fmt.Errorf("Unsupported type")
+	}
+}
+
+// toCopyMappers convert values to fields of a COPY INTO record. Strings are
+// always quoted so that an empty string is not mistaken for NULL.
+var toCopyMappers = map[string]toMonetConverter{
+	"int":          toString,
+	"int8":         toString,
+	"int16":        toString,
+	"int32":        toString,
+	"int64":        toString,
+	"float":        toString,
+	"float32":      toString,
+	"float64":      toString,
+	"bool":         toString,
+	"string":       toCopyString,
+	"nil":          toCopyNull,
+	"[]uint8":      toCopyByteString,
+	"time.Time":    toCopyString,
+	"monetdb.Time": toCopyDateTimeString,
+	"monetdb.Date": toCopyDateTimeString,
+}
+
+func convertToCopy(value driver.Value) (string, error) {
+	t := reflect.TypeOf(value)
+	n := "nil"
+	if t != nil {
+		n = t.String()
+	}
+
+	if mapper, ok := toCopyMappers[n]; ok {
+		return mapper(value)
+	}
+	return "", fmt.Errorf("Type not supported: %v", t)
+}
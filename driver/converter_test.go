@@ -80,6 +80,10 @@ func TestConvertToGo(t *testing.T) {
 		tc{"'quoted \\\\\\'string\\\\\\''", "char", "quoted \\'string\\'"},
 		tc{"'back\\\\slashed'", "char", "back\\slashed"},
 		tc{"'ABC'", "blob", []uint8{0x41, 0x42, 0x43}},
+		tc{"NULL", "varchar", nil},
+		tc{"'NULL'", "varchar", "NULL"},
+		tc{"NULL", "bigint", nil},
+		tc{"NULL", "double", nil},
 	}
 
 	for _, c := range tcs {
@@ -109,3 +113,33 @@ func compareByteArray(t *testing.T, val []byte, e driver.Value) bool {
 		return false
 	}
 }
+
+func TestConvertToCopy(t *testing.T) {
+	type tc struct {
+		v driver.Value
+		e string
+	}
+	var tcs = []tc{
+		tc{1, "1"},
+		tc{int64(64), "64"},
+		tc{float64(6.4), "6.4"},
+		tc{true, "true"},
+		tc{nil, ""},
+		tc{"", "\"\""},
+		tc{"string", "\"string\""},
+		tc{"quoted \"string\"", "\"quoted \\\"string\\\"\""},
+		tc{"back\\slashed", "\"back\\\\slashed\""},
+		tc{"new\nline", "\"new\\nline\""},
+		tc{"pipe|d", "\"pipe|d\""},
+		tc{Date{2001, time.January, 2}, "\"2001-01-02\""},
+	}
+
+	for _, c := range tcs {
+		s, err := convertToCopy(c.v)
+		if err != nil {
+			t.Errorf("Error converting value: %v -> %v", c.v, err)
+		} else if s != c.e {
+			t.Errorf("Invalid value: %s, expected: %s", s, c.e)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+const copyInSuffix = " FROM STDIN NULL AS ''"
+
+// CopyIn returns a COPY INTO statement that bulk loads the given number of
+// records into the columns of a table.
+//
+// Prepare the statement in a transaction, call Exec once per record with
+// the column values, then call Exec without arguments to send the records
+// to MonetDB:
+//
+//	stmt, err := tx.Prepare(monetdb.CopyIn(len(rows), "table", "a", "b"))
+//	for _, row := range rows {
+//		_, err = stmt.Exec(row.A, row.B)
+//	}
+//	res, err := stmt.Exec()
+func CopyIn(records int, table string, columns ...string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = QuoteIdentifier(column)
+	}
+
+	return fmt.Sprintf("COPY %d RECORDS INTO %s (%s)%s",
+		records, QuoteIdentifier(table), strings.Join(quoted, ", "), copyInSuffix)
+}
+
+func isCopyIn(query string) bool {
+	return strings.HasPrefix(query, "COPY ") && strings.HasSuffix(query, copyInSuffix)
+}
+
+// QuoteIdentifier quotes a table or column name for use in a query.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// CopyStmt buffers records for a COPY INTO statement created by CopyIn.
+type CopyStmt struct {
+	conn  *Conn
+	query string
+
+	records bytes.Buffer
+}
+
+var _ driver.StmtExecContext = &CopyStmt{}
+
+func newCopyStmt(c *Conn, q string) *CopyStmt {
+	return &CopyStmt{
+		conn:  c,
+		query: q,
+	}
+}
+
+func (s *CopyStmt) Close() error {
+	s.conn = nil
+	return nil
+}
+
+func (s *CopyStmt) NumInput() int {
+	return -1
+}
+
+// Exec adds a record to the buffer, or sends all buffered records to
+// MonetDB when called without arguments.
+func (s *CopyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.exec(context.Background(), args)
+}
+
+// ExecContext is Exec, sending the records is interrupted when ctx is done.
+func (s *CopyStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.exec(ctx, values)
+}
+
+func (s *CopyStmt) exec(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	res := newResult()
+
+	if len(args) > 0 {
+		res.err = s.addRecord(args)
+		return res, res.err
+	}
+
+	if s.conn == nil || s.conn.mapi == nil {
+		res.err = fmt.Errorf("Database connection closed")
+		return res, res.err
+	}
+
+	var r string
+	err := s.conn.mapi.WithContext(ctx, func() error {
+		var err error
+		r, err = s.conn.mapi.CopyIn(fmt.Sprintf("s%s;", s.query), &s.records)
+		return err
+	})
+	s.records.Reset()
+	if err != nil {
+		res.err = err
+		return res, res.err
+	}
+
+	qr := &queryResults{}
+	err = qr.storeResult(r)
+	res.rowsAffected = qr.rowCount
+	res.err = err
+
+	return res, res.err
+}
+
+func (s *CopyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("COPY INTO statements cannot be queried")
+}
+
+func (s *CopyStmt) addRecord(args []driver.Value) error {
+	for i, v := range args {
+		str, err := convertToCopy(v)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			s.records.WriteString("|")
+		}
+		s.records.WriteString(str)
+	}
+	s.records.WriteString("\n")
+	return nil
+}
@@ -0,0 +1,135 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"database/sql/driver"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCopyInQuery(t *testing.T) {
+	q := CopyIn(3, `my"table`, "timestamp", "value")
+	e := `COPY 3 RECORDS INTO "my""table" ("timestamp", "value") FROM STDIN NULL AS ''`
+	if q != e {
+		t.Errorf("Invalid query: %s, expected: %s", q, e)
+	}
+	if !isCopyIn(q) {
+		t.Errorf("Query not recognized as COPY INTO: %s", q)
+	}
+	if isCopyIn("SELECT 1") {
+		t.Errorf("Query wrongly recognized as COPY INTO")
+	}
+}
+
+// mapiPair returns a client and a server MAPI connection talking to each other.
+func mapiPair(t *testing.T) (*MapiConn, *MapiConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &MapiConn{State: MAPI_STATE_READY, conn: conn}
+	server := &MapiConn{State: MAPI_STATE_READY, conn: <-accepted}
+	return client, server
+}
+
+func TestCopyInExchange(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	// enough records to need more than one chunk
+	var records strings.Builder
+	for records.Len() <= mapi_COPY_CHUNK_SIZE {
+		records.WriteString("1|2.5|\"label\"\n")
+	}
+	data := records.String()
+
+	received := make(chan string)
+	go func() {
+		var b strings.Builder
+		for {
+			block, err := server.getBlock()
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			if len(block) == 0 {
+				break
+			}
+			b.Write(block)
+			server.putBlock([]byte(mapi_MSG_MORE))
+		}
+		server.putBlock([]byte("&2 42 -1\n"))
+		received <- b.String()
+	}()
+
+	op := "sCOPY INTO t FROM STDIN;"
+	r, err := client.CopyIn(op, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error copying records: %v", err)
+	}
+	if r != "&2 42 -1\n" {
+		t.Errorf("Invalid reply: %q", r)
+	}
+	if got := <-received; got != op+"\n"+data {
+		t.Errorf("Server received %d bytes, expected %d", len(got), len(op)+1+len(data))
+	}
+}
+
+func TestCopyStmt(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	received := make(chan string)
+	go func() {
+		block, err := server.getBlock()
+		if err != nil {
+			t.Error(err)
+		}
+		server.putBlock([]byte(mapi_MSG_MORE))
+		server.getBlock()
+		server.putBlock([]byte("&2 2 -1\n"))
+		received <- string(block)
+	}()
+
+	s := newCopyStmt(&Conn{mapi: client}, CopyIn(2, "t", "a", "b"))
+	for _, args := range [][]driver.Value{{int64(1), "x"}, {int64(2), nil}} {
+		if _, err := s.Exec(args); err != nil {
+			t.Fatalf("Error adding record: %v", err)
+		}
+	}
+
+	res, err := s.Exec(nil)
+	if err != nil {
+		t.Fatalf("Error executing COPY INTO: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("Invalid rows affected: %d, expected: 2", n)
+	}
+
+	e := "sCOPY 2 RECORDS INTO \"t\" (\"a\", \"b\") FROM STDIN NULL AS '';\n1|\"x\"\n2|\n"
+	if got := <-received; got != e {
+		t.Errorf("Invalid block: %q, expected: %q", got, e)
+	}
+}
@@ -5,11 +5,17 @@
 package monetdb
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func init() {
@@ -25,6 +31,23 @@ type config struct {
 	Hostname string
 	Database string
 	Port     int
+
+	// path of the Unix socket to connect to instead of Hostname and Port
+	Socket string
+	// nil for a plain connection
+	TLS *tls.Config
+
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// number of rows fetched at once, 0 for the server's default
+	ReplySize  int
+	Autocommit bool
+	// offset like +01:00 the session's time zone is set to, empty for the server's
+	Timezone string
+	Schema   string
+	Language string
 }
 
 func (*Driver) Open(name string) (driver.Conn, error) {
@@ -35,18 +58,54 @@ func (*Driver) Open(name string) (driver.Conn, error) {
 	return newConn(c)
 }
 
+// parseDSN parses a DSN in either the URL form
+//
+//	monetdb://[username[:password]@]hostname[:port]/database[?params]
+//
+// or the original form
+//
+//	[username[:password]@]hostname[:port]/database[?params]
 func parseDSN(name string) (config, error) {
-	re := regexp.MustCompile(`^((?P<username>[^:]+?)(:(?P<password>[^@]+?))?@)?(?P<hostname>[a-zA-Z0-9.]+?)(:(?P<port>\d+?))?/(?P<database>.+?)$`)
+	c := config{
+		Hostname:   "localhost",
+		Port:       50000,
+		Autocommit: true,
+		Language:   "sql",
+	}
+
+	var params string
+	var err error
+	if strings.HasPrefix(name, "monetdb://") {
+		params, err = parseURL(name, &c)
+	} else {
+		params, err = parseLegacyDSN(name, &c)
+	}
+	if err != nil {
+		return config{}, err
+	}
+
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return config{}, fmt.Errorf("Invalid DSN parameters: %s", err)
+	}
+	err = parseParams(values, &c)
+	if err != nil {
+		return config{}, err
+	}
+
+	return c, nil
+}
+
+func parseLegacyDSN(name string, c *config) (string, error) {
+	name, params := splitParams(name)
+
+	re := regexp.MustCompile(`^((?P<username>[^:]+?)(:(?P<password>[^@]+?))?@)?(?P<hostname>[a-zA-Z0-9.-]+?)(:(?P<port>\d+?))?/(?P<database>.+?)$`)
 	if !re.MatchString(name) {
-		return config{}, fmt.Errorf("Invalid DSN")
+		return "", fmt.Errorf("Invalid DSN")
 	}
 	m := re.FindAllStringSubmatch(name, -1)[0]
 	n := re.SubexpNames()
 
-	c := config{
-		Hostname: "localhost",
-		Port:     50000,
-	}
 	for i, v := range m {
 		if n[i] == "username" {
 			c.Username = v
@@ -61,5 +120,201 @@ func parseDSN(name string) (config, error) {
 		}
 	}
 
+	return params, nil
+}
+
+// parseURL parses a monetdb:// DSN, which unlike the original form allows
+// any hostname, IPv6 literals in brackets and any character in passwords
+// once they're percent-encoded.
+func parseURL(name string, c *config) (string, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid DSN: %s", err)
+	}
+	if u.Opaque != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid DSN")
+	}
+
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+		if c.Username == "" {
+			return "", fmt.Errorf("Invalid DSN: empty username")
+		}
+	}
+
+	if host := u.Hostname(); host != "" {
+		c.Hostname = host
+	}
+	if port := u.Port(); port != "" {
+		c.Port, err = strconv.Atoi(port)
+		if err != nil || c.Port <= 0 || c.Port > 65535 {
+			return "", fmt.Errorf("Invalid DSN: invalid port %s", port)
+		}
+	}
+
+	c.Database = strings.TrimPrefix(u.Path, "/")
+	if c.Database == "" || strings.Contains(c.Database, "/") {
+		return "", fmt.Errorf("Invalid DSN: invalid database %q", c.Database)
+	}
+
+	return u.RawQuery, nil
+}
+
+// splitParams splits the ?key=value&... parameters off a DSN. The password
+// may contain a question mark, so they're looked for after the last @.
+func splitParams(name string) (string, string) {
+	at := strings.LastIndex(name, "@") + 1
+	q := strings.Index(name[at:], "?")
+	if q < 0 {
+		return name, ""
+	}
+	return name[:at+q], name[at+q+1:]
+}
+
+var timezoneRe = regexp.MustCompile(`^[+-]\d\d:\d\d$`)
+
+// parseParams applies the DSN parameters to c.
+//
+//	connectTimeout  maximum time connecting and logging in may take
+//	readTimeout     maximum time reading a reply may take
+//	writeTimeout    maximum time sending a command may take
+//	replySize       number of rows fetched at once
+//	autocommit      false to end every transaction with an explicit COMMIT or ROLLBACK
+//	timezone        offset like +01:00 or UTC the session's time zone is set to
+//	schema          schema the session starts in
+//	language        sql, or mal to talk to the server in MAL
+//	socket          path of a Unix socket like /tmp/.s.monetdb.50000 to connect to
+//
+// The TLS parameters are described with parseTLSParams.
+func parseParams(values url.Values, c *config) error {
+	for k, v := range values {
+		if len(v) > 1 {
+			return fmt.Errorf("DSN parameter %s given more than once", k)
+		}
+	}
+
+	var err error
+	for k := range values {
+		v := values.Get(k)
+		switch k {
+		case "connectTimeout":
+			c.ConnectTimeout, err = parseTimeout(k, v)
+		case "readTimeout":
+			c.ReadTimeout, err = parseTimeout(k, v)
+		case "writeTimeout":
+			c.WriteTimeout, err = parseTimeout(k, v)
+		case "replySize":
+			c.ReplySize, err = strconv.Atoi(v)
+			if err != nil || c.ReplySize <= 0 {
+				err = fmt.Errorf("Invalid replySize parameter: %s", v)
+			}
+		case "autocommit":
+			c.Autocommit, err = strconv.ParseBool(v)
+			if err != nil {
+				err = fmt.Errorf("Invalid autocommit parameter: %s", v)
+			}
+		case "timezone":
+			c.Timezone = v
+			if v == "UTC" || v == "Z" {
+				c.Timezone = "+00:00"
+			} else if !timezoneRe.MatchString(v) {
+				err = fmt.Errorf("Invalid timezone parameter, expected an offset like +01:00: %s", v)
+			}
+		case "schema":
+			c.Schema = v
+			if v == "" {
+				err = fmt.Errorf("Empty schema parameter")
+			}
+		case "socket":
+			c.Socket = v
+			if v == "" {
+				err = fmt.Errorf("Empty socket parameter")
+			}
+		case "language":
+			c.Language = v
+			if v != "sql" && v != "mal" {
+				err = fmt.Errorf("Invalid language parameter: %s", v)
+			}
+		case "tls", "tlsCA", "tlsCert", "tlsKey", "tlsServerName":
+		default:
+			err = fmt.Errorf("Unknown DSN parameter: %s", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Language != "sql" && (!c.Autocommit || c.Timezone != "" || c.Schema != "" || c.ReplySize != 0) {
+		return fmt.Errorf("autocommit, timezone, schema and replySize only apply to language=sql")
+	}
+
+	c.TLS, err = parseTLSParams(values)
+	if err != nil {
+		return err
+	}
+	if c.TLS != nil && c.Socket != "" {
+		return fmt.Errorf("TLS isn't supported over Unix sockets")
+	}
+	return nil
+}
+
+func parseTimeout(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid %s parameter, expected a duration like 10s: %s", name, value)
+	}
+	return d, nil
+}
+
+// parseTLSParams returns the TLS config of the DSN parameters, or nil if the
+// connection doesn't use TLS.
+//
+//	tls            true verifies the server, skip-verify doesn't; off by default
+//	tlsCA          PEM file of the CAs to verify the server with, instead of the system's
+//	tlsCert        PEM file of the client certificate
+//	tlsKey         PEM file of the client certificate's key
+//	tlsServerName  name the server certificate is verified for, the hostname by default
+func parseTLSParams(values url.Values) (*tls.Config, error) {
+	mode := values.Get("tls")
+	switch mode {
+	case "", "false":
+		if values.Get("tlsCA") != "" || values.Get("tlsCert") != "" || values.Get("tlsKey") != "" || values.Get("tlsServerName") != "" {
+			return nil, fmt.Errorf("TLS parameters given without tls=true or tls=skip-verify")
+		}
+		return nil, nil
+	case "true", "skip-verify":
+	default:
+		return nil, fmt.Errorf("Invalid tls parameter: %s", mode)
+	}
+
+	c := &tls.Config{
+		ServerName:         values.Get("tlsServerName"),
+		InsecureSkipVerify: mode == "skip-verify",
+	}
+
+	if ca := values.Get("tlsCA"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read TLS CA bundle: %s", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in TLS CA bundle %s", ca)
+		}
+	}
+
+	cert, key := values.Get("tlsCert"), values.Get("tlsKey")
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("tlsCert and tlsKey have to be given together")
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load TLS client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+
 	return c, nil
 }
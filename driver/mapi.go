@@ -5,22 +5,30 @@
 package monetdb
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto"
 	_ "crypto/md5"
 	_ "crypto/sha1"
 	_ "crypto/sha512"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	mapi_MAX_PACKAGE_LENGTH = (1024 * 8) - 2
+	mapi_COPY_CHUNK_SIZE    = 1024 * 1024
 
 	mapi_MSG_PROMPT   = ""
 	mapi_MSG_INFO     = "#"
@@ -57,6 +65,12 @@ var (
 // calling the Connect() function.
 //
 // The State value can be either MAPI_STATE_INIT or MAPI_STATE_READY.
+//
+// When UnixSocket is set, the connection is made to that Unix domain socket
+// instead of to Hostname and Port. When TLSConfig is set, the whole
+// connection runs over TLS. A non-zero
+// ConnectTimeout limits connecting and logging in, ReadTimeout and
+// WriteTimeout limit receiving and sending each block.
 type MapiConn struct {
 	Hostname string
 	Port     int
@@ -65,9 +79,21 @@ type MapiConn struct {
 	Database string
 	Language string
 
+	UnixSocket string
+	TLSConfig  *tls.Config
+
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
 	State int
 
-	conn *net.TCPConn
+	conn net.Conn
+
+	// the deadline of the running operation, and whether it was interrupted
+	deadlineMtx sync.Mutex
+	deadline    time.Time
+	interrupted bool
 }
 
 // NewMapi returns a MonetDB's MAPI connection handle.
@@ -111,16 +137,221 @@ func (c *MapiConn) Cmd(operation string) (string, error) {
 	}
 
 	resp := string(r)
+	if resp == mapi_MSG_MORE {
+		// tell server it isn't going to get more
+		return c.Cmd("")
+	}
+
+	return parseReply(resp)
+}
+
+// CmdStream sends a MAPI command to MonetDB and hands the reply to fn while
+// it's being received, instead of buffering it whole like Cmd does. Whatever
+// fn leaves unread is discarded. Error replies are returned without calling fn.
+func (c *MapiConn) CmdStream(operation string, fn func(r *bufio.Reader) error) error {
+	if c.State != MAPI_STATE_READY {
+		return fmt.Errorf("Database not connected")
+	}
+
+	if err := c.putBlock([]byte(operation)); err != nil {
+		return err
+	}
+
+	for {
+		r := bufio.NewReader(c.newBlockReader())
+		first, err := r.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if len(first) == 0 || (first[0] != mapi_MSG_ERROR[0] && first[0] != mapi_MSG_MORE[0]) {
+			err = fn(r)
+			// the connection has to be at the end of the block for the next command
+			if _, derr := io.Copy(ioutil.Discard, r); derr != nil {
+				return derr
+			}
+			return err
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if string(b) != mapi_MSG_MORE {
+			_, err = parseReply(string(b))
+			return err
+		}
+
+		// tell server it isn't going to get more
+		if err := c.putBlock(nil); err != nil {
+			return err
+		}
+	}
+}
+
+// CmdStreamContext is CmdStream, giving up when ctx is done like CmdContext.
+func (c *MapiConn) CmdStreamContext(ctx context.Context, operation string, fn func(r *bufio.Reader) error) error {
+	return c.WithContext(ctx, func() error {
+		return c.CmdStream(operation, fn)
+	})
+}
+
+// CmdContext sends a MAPI command to MonetDB, giving up when ctx is done.
+//
+// See WithContext for what happens to the connection when a command is
+// interrupted.
+func (c *MapiConn) CmdContext(ctx context.Context, operation string) (string, error) {
+	var resp string
+	err := c.WithContext(ctx, func() error {
+		var err error
+		resp, err = c.Cmd(operation)
+		return err
+	})
+	return resp, err
+}
+
+// WithContext runs fn, which talks to MonetDB over the connection, with the
+// deadline of ctx applied to the connection. When ctx is cancelled while fn
+// is running, any blocking read or write of the connection is interrupted.
+//
+// MAPI has no way of telling the server to stop working on a command, and
+// the reply to an interrupted command could still arrive at any point, so
+// the connection is closed and the error of ctx returned.
+func (c *MapiConn) WithContext(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.conn == nil {
+		return fmt.Errorf("Database not connected")
+	}
+
+	conn := c.conn
+	deadline, _ := ctx.Deadline()
+	c.setDeadline(deadline)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.interrupt(conn)
+		case <-done:
+		}
+	}()
+
+	err := fn()
+	close(done)
+	<-stopped
+
+	// the deadline of ctx doesn't apply to the next operation
+	c.setDeadline(time.Time{})
+
+	if err != nil {
+		ne, isNetErr := err.(net.Error)
+		if ctx.Err() != nil || (isNetErr && ne.Timeout() && !deadline.IsZero() && !time.Now().Before(deadline)) {
+			c.Disconnect()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// setDeadline sets the deadline of the next operation, on top of the read
+// and write timeouts, and clears any interrupt.
+func (c *MapiConn) setDeadline(deadline time.Time) {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+	c.deadline = deadline
+	c.interrupted = false
+}
+
+// interrupt fails blocked and future reads and writes of conn until the
+// deadline is set again.
+func (c *MapiConn) interrupt(conn net.Conn) {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+	c.interrupted = true
+	conn.SetDeadline(time.Unix(1, 0))
+}
+
+// applyDeadline sets the deadline of a read or write that may take timeout
+// through set, unless the operation was interrupted.
+func (c *MapiConn) applyDeadline(set func(time.Time) error, timeout time.Duration) {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+	if c.interrupted {
+		return
+	}
+
+	deadline := c.deadline
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	set(deadline)
+}
+
+// CopyIn sends a COPY ... FROM STDIN operation to MonetDB followed by
+// the records read from r.
+//
+// The first chunk of records is sent along with the operation, after
+// which the remaining records are sent one chunk at a time whenever the
+// server asks for more. An empty block tells the server that there are
+// no more records.
+func (c *MapiConn) CopyIn(operation string, r io.Reader) (string, error) {
+	if c.State != MAPI_STATE_READY {
+		return "", fmt.Errorf("Database not connected")
+	}
+
+	chunk := make([]byte, mapi_COPY_CHUNK_SIZE)
+	n, err := io.ReadFull(r, chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	block := append([]byte(operation+"\n"), chunk[:n]...)
+	for {
+		if err := c.putBlock(block); err != nil {
+			return "", err
+		}
+
+		b, err := c.getBlock()
+		if err != nil {
+			return "", err
+		}
+
+		resp := string(b)
+		if resp != mapi_MSG_MORE {
+			return parseReply(resp)
+		}
+		if len(block) == 0 {
+			return "", fmt.Errorf("Server asked for more records after the end of the data")
+		}
+
+		n, err = io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		block = chunk[:n]
+	}
+}
+
+// parseReply interprets a response block sent by MonetDB.
+func parseReply(resp string) (string, error) {
 	if len(resp) == 0 {
 		return "", nil
 
 	} else if strings.HasPrefix(resp, mapi_MSG_OK) {
 		return strings.TrimSpace(resp[3:]), nil
 
-	} else if resp == mapi_MSG_MORE {
-		// tell server it isn't going to get more
-		return c.Cmd("")
-
 	} else if strings.HasPrefix(resp, mapi_MSG_Q) || strings.HasPrefix(resp, mapi_MSG_HEADER) || strings.HasPrefix(resp, mapi_MSG_TUPLE) {
 		return resp, nil
 
@@ -139,22 +370,21 @@ func (c *MapiConn) Connect() error {
 		c.conn = nil
 	}
 
-	addr := fmt.Sprintf("%s:%d", c.Hostname, c.Port)
-	raddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return err
+	var deadline time.Time
+	if c.ConnectTimeout > 0 {
+		deadline = time.Now().Add(c.ConnectTimeout)
 	}
 
-	conn, err := net.DialTCP("tcp", nil, raddr)
+	conn, err := c.dial(deadline)
 	if err != nil {
 		return err
 	}
-
-	conn.SetKeepAlive(false)
-	conn.SetNoDelay(true)
 	c.conn = conn
 
+	// the connect timeout covers logging in, but not what comes after it
+	c.setDeadline(deadline)
 	err = c.login()
+	c.setDeadline(time.Time{})
 	if err != nil {
 		return err
 	}
@@ -162,6 +392,63 @@ func (c *MapiConn) Connect() error {
 	return nil
 }
 
+// dial opens the connection to the server, ready for logging in
+func (c *MapiConn) dial(deadline time.Time) (net.Conn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+
+	if c.UnixSocket != "" {
+		conn, err := dialer.Dial("unix", c.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+
+		// the server expects a 0 before the login on Unix sockets, anything
+		// else means a file descriptor is going to be passed
+		conn.SetDeadline(deadline)
+		_, err = conn.Write([]byte("0"))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	tcpConn.SetKeepAlive(false)
+	tcpConn.SetNoDelay(true)
+
+	if c.TLSConfig != nil {
+		conn.SetDeadline(deadline)
+		conn, err = c.tlsHandshake(conn)
+		if err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// tlsHandshake starts TLS over conn, verifying the server for the current
+// hostname unless another name is configured.
+func (c *MapiConn) tlsHandshake(conn net.Conn) (net.Conn, error) {
+	config := c.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = c.Hostname
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	return tlsConn, nil
+}
+
 // login starts the login sequence
 func (c *MapiConn) login() error {
 	return c.tryLogin(0)
@@ -213,13 +500,15 @@ func (c *MapiConn) tryLogin(iteration int) error {
 			}
 
 		} else if r[1] == "monetdb" {
-			c.Hostname = r[2][2:]
-			t = strings.Split(r[3], "/")
-			port, _ := strconv.ParseInt(t[0], 10, 32)
-			c.Port = int(port)
-			c.Database = t[1]
+			err := c.redirect(t[0][1:])
+			if err != nil {
+				return err
+			}
 			c.conn.Close()
-			c.Connect()
+			err = c.Connect()
+			if err != nil {
+				return err
+			}
 
 		} else {
 			return fmt.Errorf("Unknown redirect: %s", prompt)
@@ -233,6 +522,34 @@ func (c *MapiConn) tryLogin(iteration int) error {
 	return nil
 }
 
+// redirect points the connection to the server of a redirect like
+// mapi:monetdb://host:port/database or, for a Unix socket,
+// mapi:monetdb:///path/to/.s.monetdb.50000?database=database
+func (c *MapiConn) redirect(to string) error {
+	u, err := url.Parse(strings.TrimPrefix(to, "mapi:"))
+	if err != nil {
+		return fmt.Errorf("Invalid redirect %s: %s", to, err)
+	}
+
+	if u.Host == "" {
+		c.UnixSocket = u.Path
+		c.Database = u.Query().Get("database")
+	} else {
+		c.UnixSocket = ""
+		c.Hostname = u.Hostname()
+		c.Port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return fmt.Errorf("Invalid redirect %s: %s", to, err)
+		}
+		c.Database = strings.TrimPrefix(u.Path, "/")
+	}
+
+	if c.Database == "" {
+		return fmt.Errorf("Invalid redirect %s: no database", to)
+	}
+	return nil
+}
+
 // challengeResponse produces a response given a challenge
 func (c *MapiConn) challengeResponse(challenge []byte) (string, error) {
 	t := strings.Split(string(challenge), ":")
@@ -279,56 +596,90 @@ func (c *MapiConn) challengeResponse(challenge []byte) (string, error) {
 
 // getBlock retrieves a block of message
 func (c *MapiConn) getBlock() ([]byte, error) {
-	r := new(bytes.Buffer)
+	if c.conn == nil {
+		return nil, fmt.Errorf("Database not connected")
+	}
+	return ioutil.ReadAll(c.newBlockReader())
+}
 
-	last := 0
-	for last != 1 {
-		flag, err := c.getBytes(2)
-		if err != nil {
-			return nil, err
-		}
+// blockReader reads a block sent by MonetDB as a stream, one packet at a
+// time, so large replies don't have to be buffered whole.
+type blockReader struct {
+	c    *MapiConn
+	conn net.Conn
 
-		var unpacked uint16
-		buf := bytes.NewBuffer(flag)
-		err = binary.Read(buf, binary.LittleEndian, &unpacked)
-		if err != nil {
-			return nil, err
-		}
+	// bytes left of the current packet, and whether it's the last one
+	remaining int
+	last      bool
 
-		length := unpacked >> 1
-		last = int(unpacked & 1)
+	err error
+}
 
-		d, err := c.getBytes(int(length))
-		if err != nil {
-			return nil, err
-		}
+func (c *MapiConn) newBlockReader() *blockReader {
+	c.applyDeadline(c.conn.SetReadDeadline, c.ReadTimeout)
+	return &blockReader{c: c, conn: c.conn}
+}
 
-		r.Write(d)
+func (r *blockReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
 	}
 
-	return r.Bytes(), nil
-}
-
-// getBytes reads the given amount of bytes
-func (c *MapiConn) getBytes(count int) ([]byte, error) {
-	r := make([]byte, count)
-	b := make([]byte, count)
+	for r.remaining == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
 
-	read := 0
-	for read < count {
-		n, err := c.conn.Read(b)
-		if err != nil {
-			return nil, err
+		var header [2]byte
+		if _, err := io.ReadFull(r.conn, header[:]); err != nil {
+			return 0, r.fail(err)
 		}
-		copy(r[read:], b[:n])
-		read += n
+		flag := binary.LittleEndian.Uint16(header[:])
+		r.remaining = int(flag >> 1)
+		r.last = flag&1 == 1
 	}
 
-	return r, nil
+	// reading any more than the packet would eat into the next one
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.conn.Read(p)
+	r.remaining -= n
+	if err != nil {
+		return n, r.fail(err)
+	}
+	return n, nil
+}
+
+// fail closes the connection, as the rest of the block could still arrive
+func (r *blockReader) fail(err error) error {
+	// only the end of the block is an EOF, the connection closing isn't
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+	r.c.Disconnect()
+	return err
 }
 
 // putBlock sends the given data as one or more blocks
 func (c *MapiConn) putBlock(b []byte) error {
+	if c.conn == nil {
+		return fmt.Errorf("Database not connected")
+	}
+	c.applyDeadline(c.conn.SetWriteDeadline, c.WriteTimeout)
+
+	err := c.writeBlock(b)
+	if err != nil {
+		// the server could have gotten part of the block
+		c.Disconnect()
+		return err
+	}
+	return nil
+}
+
+// writeBlock writes b as packets of at most mapi_MAX_PACKAGE_LENGTH
+func (c *MapiConn) writeBlock(b []byte) error {
 	pos := 0
 	last := 0
 	for last != 1 {
@@ -5,13 +5,19 @@
 package monetdb
 
 import (
+	"context"
 	"database/sql/driver"
 	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
 )
 
 type Rows struct {
 	stmt   *Stmt
+	ctx    context.Context
 	active bool
 
 	queryId int
@@ -27,9 +33,18 @@ type Rows struct {
 	columns     []string
 }
 
+var (
+	_ driver.RowsColumnTypeDatabaseTypeName = &Rows{}
+	_ driver.RowsColumnTypeScanType         = &Rows{}
+	_ driver.RowsColumnTypeLength           = &Rows{}
+	_ driver.RowsColumnTypePrecisionScale   = &Rows{}
+	_ driver.RowsColumnTypeNullable         = &Rows{}
+)
+
 func newRows(s *Stmt) *Rows {
 	return &Rows{
 		stmt:   s,
+		ctx:    context.Background(),
 		active: true,
 		err:    nil,
 
@@ -48,6 +63,83 @@ func (r *Rows) Columns() []string {
 	return r.columns
 }
 
+// ColumnTypeDatabaseTypeName returns the MonetDB type of a column in upper
+// case, like VARCHAR or DECIMAL.
+func (r *Rows) ColumnTypeDatabaseTypeName(index int) string {
+	return strings.ToUpper(r.description[index].columnType)
+}
+
+// scanTypes are the types values of each MonetDB type are scanned as
+var scanTypes = map[string]reflect.Type{
+	mdb_CHAR:           reflect.TypeOf(""),
+	mdb_VARCHAR:        reflect.TypeOf(""),
+	mdb_CLOB:           reflect.TypeOf(""),
+	mdb_BLOB:           reflect.TypeOf([]byte{}),
+	mdb_DECIMAL:        reflect.TypeOf(float64(0)),
+	mdb_SMALLINT:       reflect.TypeOf(int16(0)),
+	mdb_INT:            reflect.TypeOf(int32(0)),
+	mdb_WRD:            reflect.TypeOf(int32(0)),
+	mdb_BIGINT:         reflect.TypeOf(int64(0)),
+	mdb_HUGEINT:        reflect.TypeOf(int64(0)),
+	mdb_SERIAL:         reflect.TypeOf(int64(0)),
+	mdb_REAL:           reflect.TypeOf(float32(0)),
+	mdb_DOUBLE:         reflect.TypeOf(float64(0)),
+	mdb_BOOLEAN:        reflect.TypeOf(false),
+	mdb_DATE:           reflect.TypeOf(Date{}),
+	mdb_TIME:           reflect.TypeOf(Time{}),
+	mdb_TIMESTAMP:      reflect.TypeOf(time.Time{}),
+	mdb_TIMESTAMPTZ:    reflect.TypeOf(time.Time{}),
+	mdb_INTERVAL:       reflect.TypeOf(""),
+	mdb_MONTH_INTERVAL: reflect.TypeOf(""),
+	mdb_SEC_INTERVAL:   reflect.TypeOf(""),
+	mdb_TINYINT:        reflect.TypeOf(int8(0)),
+	mdb_SHORTINT:       reflect.TypeOf(int16(0)),
+	mdb_MEDIUMINT:      reflect.TypeOf(int32(0)),
+	mdb_LONGINT:        reflect.TypeOf(int64(0)),
+	mdb_FLOAT:          reflect.TypeOf(float32(0)),
+}
+
+// ColumnTypeScanType returns the Go type the values of a column can be
+// scanned into, which matches what convertToGo returns for it.
+func (r *Rows) ColumnTypeScanType(index int) reflect.Type {
+	if t, ok := scanTypes[r.description[index].columnType]; ok {
+		return t
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+// ColumnTypeLength returns the declared length of character and binary
+// columns, or math.MaxInt64 if they're unbounded like CLOB.
+func (r *Rows) ColumnTypeLength(index int) (int64, bool) {
+	d := r.description[index]
+	switch d.columnType {
+	case mdb_CHAR, mdb_VARCHAR, mdb_CLOB, mdb_BLOB:
+		if d.internalSize > 0 {
+			return int64(d.internalSize), true
+		}
+		return math.MaxInt64, true
+	}
+	return 0, false
+}
+
+// ColumnTypePrecisionScale returns the precision and scale of decimal columns.
+func (r *Rows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	d := r.description[index]
+	if d.columnType != mdb_DECIMAL {
+		return 0, 0, false
+	}
+	return int64(d.precision), int64(d.scale), true
+}
+
+// ColumnTypeNullable returns whether a column is nullable, if known.
+func (r *Rows) ColumnTypeNullable(index int) (bool, bool) {
+	d := r.description[index]
+	if d.nullOk < 0 {
+		return false, false
+	}
+	return d.nullOk == 1, true
+}
+
 func (r *Rows) Close() error {
 	r.active = false
 	return nil
@@ -87,6 +179,7 @@ func (r *Rows) Next(dest []driver.Value) error {
 }
 
 const (
+	// the server's default reply size
 	c_ARRAY_SIZE = 100
 )
 
@@ -104,16 +197,19 @@ func (r *Rows) fetchNext() error {
 	}
 
 	r.offset += len(r.rows)
-	end := min(r.rowCount, r.rowNum+c_ARRAY_SIZE)
+	size := r.stmt.conn.config.ReplySize
+	if size == 0 {
+		size = c_ARRAY_SIZE
+	}
+	end := min(r.rowCount, r.rowNum+size)
 	amount := end - r.offset
 
 	cmd := fmt.Sprintf("Xexport %d %d %d", r.queryId, r.offset, amount)
-	res, err := r.stmt.conn.cmd(cmd)
+	err := r.stmt.conn.cmdStreamContext(r.ctx, cmd, r.stmt.readResult)
 	if err != nil {
 		return err
 	}
 
-	r.stmt.storeResult(res)
 	r.rows = r.stmt.rows
 	r.description = r.stmt.description
 
@@ -0,0 +1,168 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tupleBlock returns a reply with the tuples of rows from to to-1
+func tupleBlock(from, to int) string {
+	var b strings.Builder
+	for i := from; i < to; i++ {
+		fmt.Fprintf(&b, "[ %d,\t\"%s\"\t]\n", i, strings.Repeat("x", 100))
+	}
+	return b.String()
+}
+
+func TestQueryFetchesInBlocks(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	header := "% .t,\t.t # table_name\n% i,\ts # name\n% int,\tclob # type\n% 4,\t100 # length\n"
+	replies := map[string]string{
+		// the first block spans many packets
+		"sEXEC 1 ();":        "&1 0 1500 2 1000\n" + header + tupleBlock(0, 1000),
+		"Xexport 0 1000 500": "&6 0 500 2 1000\n" + tupleBlock(1000, 1500),
+	}
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			b, err := server.getBlock()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(b)
+			server.putBlock([]byte(replies[string(b)]))
+		}
+	}()
+
+	conn := &Conn{mapi: client, config: config{ReplySize: 1000}}
+	stmt := newStmt(conn, "SELECT i, s FROM t")
+	stmt.execId = 1
+
+	rows, err := stmt.QueryContext(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Error running query: %v", err)
+	}
+	if cols := rows.Columns(); !reflect.DeepEqual(cols, []string{"i", "s"}) {
+		t.Errorf("Invalid columns: %v", cols)
+	}
+
+	n := 0
+	dest := make([]driver.Value, 2)
+	for {
+		err := rows.Next(dest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading row %d: %v", n, err)
+		}
+		if dest[0] != int32(n) || len(dest[1].([]byte)) != 100 {
+			t.Fatalf("Invalid row %d: %v", n, dest)
+		}
+		n++
+	}
+	if n != 1500 {
+		t.Errorf("Invalid number of rows: %d, expected: 1500", n)
+	}
+
+	client.Disconnect()
+	cmds := []string{}
+	for cmd := range received {
+		cmds = append(cmds, cmd)
+	}
+	if e := []string{"sEXEC 1 ();", "Xexport 0 1000 500"}; !reflect.DeepEqual(cmds, e) {
+		t.Errorf("Invalid commands: %q, expected: %q", cmds, e)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	client, server := mapiPair(t)
+	defer client.Disconnect()
+	defer server.Disconnect()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			server.getBlock()
+			server.putBlock([]byte("!42000!syntax error\n"))
+		}
+	}()
+
+	conn := &Conn{mapi: client}
+	stmt := newStmt(conn, "SELEC 1")
+	stmt.execId = 1
+
+	_, err := stmt.QueryContext(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "syntax error") {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	// the connection can still be used after an error reply
+	_, err = stmt.QueryContext(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "syntax error") {
+		t.Errorf("Invalid error: %v", err)
+	}
+}
+
+func TestColumnTypes(t *testing.T) {
+	stmt := newStmt(&Conn{}, "SELECT name, price, note, n FROM t")
+	err := stmt.storeResult("&1 0 0 4 0\n" +
+		"% .t,\t.t,\t.t,\t.t # table_name\n" +
+		"% name,\tprice,\tnote,\tn # name\n" +
+		"% varchar,\tdecimal,\tclob,\tint # type\n" +
+		"% 5,\t12,\t0,\t1 # length\n" +
+		"% 20 0,\t10 2,\t0 0,\t32 0 # typesizes\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := newRows(stmt)
+	rows.description = stmt.description
+
+	tcs := []struct {
+		name      string
+		scanType  reflect.Type
+		length    int64
+		hasLength bool
+		precision int64
+		scale     int64
+		decimal   bool
+	}{
+		{"VARCHAR", reflect.TypeOf(""), 20, true, 0, 0, false},
+		{"DECIMAL", reflect.TypeOf(float64(0)), 0, false, 10, 2, true},
+		{"CLOB", reflect.TypeOf(""), math.MaxInt64, true, 0, 0, false},
+		{"INT", reflect.TypeOf(int32(0)), 0, false, 0, 0, false},
+	}
+
+	for i, tc := range tcs {
+		if name := rows.ColumnTypeDatabaseTypeName(i); name != tc.name {
+			t.Errorf("Invalid type name of column %d: %s, expected: %s", i, name, tc.name)
+		}
+		if scanType := rows.ColumnTypeScanType(i); scanType != tc.scanType {
+			t.Errorf("Invalid scan type of column %d: %s, expected: %s", i, scanType, tc.scanType)
+		}
+		if length, ok := rows.ColumnTypeLength(i); length != tc.length || ok != tc.hasLength {
+			t.Errorf("Invalid length of column %d: %d %v, expected: %d %v", i, length, ok, tc.length, tc.hasLength)
+		}
+		if precision, scale, ok := rows.ColumnTypePrecisionScale(i); precision != tc.precision || scale != tc.scale || ok != tc.decimal {
+			t.Errorf("Invalid precision and scale of column %d: %d %d %v, expected: %d %d %v", i, precision, scale, ok, tc.precision, tc.scale, tc.decimal)
+		}
+		// the headers don't include nullability
+		if _, ok := rows.ColumnTypeNullable(i); ok {
+			t.Errorf("Nullability of column %d reported as known", i)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monetdb-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".s.monetdb.50000")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, dsn := range []string{"monetdb://me:secret@/db?socket=" + path, "me:secret@localhost/db?socket=" + path} {
+		logins := make(chan string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			handshake := make([]byte, 1)
+			_, err = io.ReadFull(conn, handshake)
+			if err != nil || string(handshake) != "0" {
+				conn.Close()
+				return
+			}
+
+			serveLogin(conn, logins)
+		}()
+
+		c, err := parseDSN(dsn)
+		if err != nil {
+			t.Fatalf("Error parsing DSN %s: %v", dsn, err)
+		}
+		conn, err := newConn(c)
+		if err != nil {
+			t.Errorf("Error connecting with %s: %v", dsn, err)
+			continue
+		}
+		conn.Close()
+
+		select {
+		case login := <-logins:
+			if !strings.HasPrefix(login, "BIG:me:{SHA1}") || !strings.HasSuffix(login, ":sql:db:") {
+				t.Errorf("Invalid login with %s: %s", dsn, login)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("Server didn't get a login with %s", dsn)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tcs := []struct {
+		to       string
+		ok       bool
+		hostname string
+		port     int
+		socket   string
+		database string
+	}{
+		{"mapi:monetdb://db.example.com:50001/demo", true, "db.example.com", 50001, "", "demo"},
+		{"mapi:monetdb://[::1]:50001/demo", true, "::1", 50001, "", "demo"},
+		{"mapi:monetdb:///tmp/.s.monetdb.50001?database=demo", true, "localhost", 50000, "/tmp/.s.monetdb.50001", "demo"},
+		{"mapi:monetdb://db.example.com/demo", false, "", 0, "", ""},
+		{"mapi:monetdb:///tmp/.s.monetdb.50001", false, "", 0, "", ""},
+	}
+
+	for _, tc := range tcs {
+		c := NewMapi("localhost", 50000, "me", "secret", "db", "sql")
+		err := c.redirect(tc.to)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("Expected an error for redirect %s", tc.to)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error following redirect %s: %v", tc.to, err)
+			continue
+		}
+
+		if c.Hostname != tc.hostname || c.Port != tc.port || c.UnixSocket != tc.socket || c.Database != tc.database {
+			t.Errorf("Invalid redirect %s: %s:%d %q %s", tc.to, c.Hostname, c.Port, c.UnixSocket, c.Database)
+		}
+	}
+}
@@ -5,9 +5,12 @@
 package monetdb
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"database/sql/driver"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -35,9 +38,15 @@ type description struct {
 	internalSize int
 	precision    int
 	scale        int
-	nullOk       int
+	// 1 for nullable columns, 0 for columns that aren't and -1 if unknown
+	nullOk int
 }
 
+var (
+	_ driver.StmtExecContext  = &Stmt{}
+	_ driver.StmtQueryContext = &Stmt{}
+)
+
 func newStmt(c *Conn, q string) *Stmt {
 	s := &Stmt{
 		conn:   c,
@@ -57,9 +66,21 @@ func (s *Stmt) NumInput() int {
 }
 
 func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.execResult(context.Background(), args)
+}
+
+func (s *Stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.execResult(ctx, values)
+}
+
+func (s *Stmt) execResult(ctx context.Context, args []driver.Value) (driver.Result, error) {
 	res := newResult()
 
-	r, err := s.exec(args)
+	r, err := s.exec(ctx, args)
 	if err != nil {
 		res.err = err
 		return res, res.err
@@ -74,15 +95,32 @@ func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
 }
 
 func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.queryRows(context.Background(), args)
+}
+
+// QueryContext runs the query, rows fetched later on are interrupted
+// when ctx is done as well.
+func (s *Stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.queryRows(ctx, values)
+}
+
+// queryRows runs the query, parsing the first block of rows while it's
+// received. The rest is fetched in blocks of the reply size as rows are read.
+func (s *Stmt) queryRows(ctx context.Context, args []driver.Value) (driver.Rows, error) {
 	rows := newRows(s)
+	rows.ctx = ctx
 
-	r, err := s.exec(args)
+	cmd, err := s.execCommand(ctx, args)
 	if err != nil {
 		rows.err = err
 		return rows, rows.err
 	}
 
-	err = s.storeResult(r)
+	rows.err = s.conn.cmdStreamContext(ctx, cmd, s.readResult)
 	rows.queryId = s.queryId
 	rows.lastRowId = s.lastRowId
 	rows.rowCount = s.rowCount
@@ -93,9 +131,19 @@ func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
 	return rows, rows.err
 }
 
-func (s *Stmt) exec(args []driver.Value) (string, error) {
+func (s *Stmt) exec(ctx context.Context, args []driver.Value) (string, error) {
+	cmd, err := s.execCommand(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	return s.conn.cmdContext(ctx, cmd)
+}
+
+// execCommand returns the command executing the prepared statement with
+// args, preparing it first if needed
+func (s *Stmt) execCommand(ctx context.Context, args []driver.Value) (string, error) {
 	if s.execId == -1 {
-		err := s.prepareQuery()
+		err := s.prepareQuery(ctx)
 		if err != nil {
 			return "", err
 		}
@@ -107,7 +155,7 @@ func (s *Stmt) exec(args []driver.Value) (string, error) {
 	for i, v := range args {
 		str, err := convertToMonet(v)
 		if err != nil {
-			return "", nil
+			return "", err
 		}
 		if i > 0 {
 			b.WriteString(", ")
@@ -116,12 +164,12 @@ func (s *Stmt) exec(args []driver.Value) (string, error) {
 	}
 
 	b.WriteString(")")
-	return s.conn.execute(b.String())
+	return fmt.Sprintf("s%s;", b.String()), nil
 }
 
-func (s *Stmt) prepareQuery() error {
+func (s *Stmt) prepareQuery(ctx context.Context) error {
 	q := fmt.Sprintf("PREPARE %s", s.query)
-	r, err := s.conn.execute(q)
+	r, err := s.conn.executeContext(ctx, q)
 	if err != nil {
 		return err
 	}
@@ -130,6 +178,11 @@ func (s *Stmt) prepareQuery() error {
 }
 
 func (s *Stmt) storeResult(r string) error {
+	return s.readResult(bufio.NewReader(strings.NewReader(r)))
+}
+
+// readResult parses a reply line by line as it's read from r
+func (s *Stmt) readResult(r *bufio.Reader) error {
 	var columnNames []string
 	var columnTypes []string
 	var displaySizes []int
@@ -138,7 +191,13 @@ func (s *Stmt) storeResult(r string) error {
 	var scales []int
 	var nullOks []int
 
-	for _, line := range strings.Split(r, "\n") {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
 		if strings.HasPrefix(line, mapi_MSG_INFO) {
 			// TODO log
 
@@ -152,6 +211,7 @@ func (s *Stmt) storeResult(r string) error {
 			s.queryId, _ = strconv.Atoi(t[0])
 			s.rowCount, _ = strconv.Atoi(t[1])
 			s.columnCount, _ = strconv.Atoi(t[2])
+			s.rows = make([][]driver.Value, 0)
 
 			columnNames = make([]string, s.columnCount)
 			columnTypes = make([]string, s.columnCount)
@@ -160,6 +220,9 @@ func (s *Stmt) storeResult(r string) error {
 			precisions = make([]int, s.columnCount)
 			scales = make([]int, s.columnCount)
 			nullOks = make([]int, s.columnCount)
+			for i := range nullOks {
+				nullOks[i] = -1
+			}
 
 		} else if strings.HasPrefix(line, mapi_MSG_TUPLE) {
 			v, err := s.parseTuple(line)
@@ -215,7 +278,7 @@ func (s *Stmt) storeResult(r string) error {
 						s = append(s, val)
 					}
 					internalSizes[i] = s[0]
-					sizes = append(sizes, s)
+					sizes[i] = s
 				}
 				for j, t := range columnTypes {
 					if t == "decimal" {
@@ -230,16 +293,14 @@ func (s *Stmt) storeResult(r string) error {
 			s.offset = 0
 			s.lastRowId = 0
 
-		} else if strings.HasPrefix(line, mapi_MSG_PROMPT) {
-			return nil
-
 		} else if strings.HasPrefix(line, mapi_MSG_ERROR) {
 			return fmt.Errorf("Database error: %s", line[1:])
 
+		} else if strings.HasPrefix(line, mapi_MSG_PROMPT) {
+			return nil
+
 		}
 	}
-
-	return fmt.Errorf("Unknown state: %s", r)
 }
 
 func (s *Stmt) parseTuple(d string) ([]driver.Value, error) {
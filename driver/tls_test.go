@@ -0,0 +1,190 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 that's valid
+// for servers and clients, returning the paths of the certificate and key.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "monetdb"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// tlsServer accepts a single TLS connection and goes through the MAPI login,
+// sending the login response it got on the returned channel.
+func tlsServer(t *testing.T, config *tls.Config) (int, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logins := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		serveLogin(tls.Server(conn, config), logins)
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port, logins
+}
+
+// serveLogin goes through the server side of the MAPI login on conn,
+// sending the login response of the client on logins, then accepts every
+// command until the connection is closed.
+func serveLogin(conn net.Conn, logins chan<- string) {
+	server := &MapiConn{State: MAPI_STATE_READY, conn: conn}
+	defer server.Disconnect()
+
+	err := server.putBlock([]byte("salt:mserver:9:SHA1,MD5:LIT:SHA512:"))
+	if err != nil {
+		return
+	}
+	response, err := server.getBlock()
+	if err != nil {
+		return
+	}
+	logins <- string(response)
+
+	for err == nil {
+		err = server.putBlock([]byte(""))
+		if err == nil {
+			_, err = server.getBlock()
+		}
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monetdb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCert(t, dir)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParseCert(t, cert))
+
+	tcs := []struct {
+		name       string
+		params     string
+		clientAuth bool
+		ok         bool
+	}{
+		{"custom CA", "tls=true&tlsCA=" + certPath, false, true},
+		{"system CAs", "tls=true", false, false},
+		{"skip verify", "tls=skip-verify", false, true},
+		{"wrong server name", "tls=true&tlsServerName=db.example.com&tlsCA=" + certPath, false, false},
+		{"client certificate", fmt.Sprintf("tls=true&tlsCA=%s&tlsCert=%s&tlsKey=%s", certPath, certPath, keyPath), true, true},
+	}
+
+	for _, tc := range tcs {
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if tc.clientAuth {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			config.ClientCAs = pool
+		}
+		port, logins := tlsServer(t, config)
+
+		c, err := parseDSN(fmt.Sprintf("me:secret@127.0.0.1:%d/db?%s", port, tc.params))
+		if err != nil {
+			t.Fatalf("Error parsing DSN for %s: %v", tc.name, err)
+		}
+		conn, err := newConn(c)
+		if conn.mapi != nil {
+			defer conn.Close()
+		}
+
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("Expected an error connecting with %s", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error connecting with %s: %v", tc.name, err)
+			continue
+		}
+
+		select {
+		case login := <-logins:
+			if !strings.HasPrefix(login, "BIG:me:{SHA1}") || !strings.HasSuffix(login, ":sql:db:") {
+				t.Errorf("Invalid login with %s: %s", tc.name, login)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("Server didn't get a login with %s", tc.name)
+		}
+		if _, ok := conn.mapi.conn.(*tls.Conn); !ok {
+			t.Errorf("Connection with %s isn't using TLS", tc.name)
+		}
+	}
+}
+
+func mustParseCert(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// reasons the adapter isn't ready to serve requests
+const (
+	notReadyPing      = "ping"
+	notReadyMetaTable = "meta_table"
+	notReadyLabelsMap = "labels_map_stale"
+)
+
+// the labelsMap may miss a few refreshes before the adapter stops being ready
+var labelsMaxAge = 3 * labelsRefreshInterval
+
+// how long pinging MonetDB may take during a readiness check
+var readinessPingTimeout = 5 * time.Second
+
+// startHealth serves /-/healthy and /-/ready on each of muxes, and keeps the
+// readiness metrics up to date even when nothing polls /-/ready
+func startHealth(bg *background, db *sql.DB, muxes ...*http.ServeMux) {
+	bg.every(labelsRefreshInterval, func(time.Time) {
+		checkReadiness(bg.ctx, db)
+	})
+
+	for _, mux := range muxes {
+		mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "OK")
+		})
+		mux.Handle("/-/ready", readyHandler(db))
+	}
+}
+
+// readyHandler responds with 503 and the reasons while the adapter isn't ready
+func readyHandler(db *sql.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reasons := checkReadiness(r.Context(), db)
+		if len(reasons) > 0 {
+			http.Error(w, "not ready: "+strings.Join(reasons, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// checkReadiness returns why the adapter can't serve requests, if anything,
+// and records the result in the readiness metrics
+func checkReadiness(ctx context.Context, db *sql.DB) []string {
+	failing := map[string]bool{}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessPingTimeout)
+	err := db.PingContext(ctx)
+	cancel()
+	failing[notReadyPing] = err != nil
+
+	refreshed := labelsRefreshedAt()
+	failing[notReadyMetaTable] = refreshed.IsZero()
+	failing[notReadyLabelsMap] = !refreshed.IsZero() && time.Since(refreshed) > labelsMaxAge
+
+	reasons := []string{}
+	for _, reason := range []string{notReadyPing, notReadyMetaTable, notReadyLabelsMap} {
+		if failing[reason] {
+			reasons = append(reasons, reason)
+			readinessFailing.WithLabelValues(reason).Set(1)
+		} else {
+			readinessFailing.WithLabelValues(reason).Set(0)
+		}
+	}
+
+	if len(reasons) > 0 {
+		ready.Set(0)
+	} else {
+		ready.Set(1)
+	}
+	return reasons
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	defer atomic.StoreInt64(&labelsRefreshed, atomic.LoadInt64(&labelsRefreshed))
+
+	// nothing listens there, so pinging fails
+	db, err := sql.Open("monetdb", "monetdb:monetdb@localhost:1/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tcs := []struct {
+		refreshed time.Time
+		reasons   []string
+	}{
+		{time.Time{}, []string{notReadyPing, notReadyMetaTable}},
+		{time.Now().Add(-labelsMaxAge - time.Minute), []string{notReadyPing, notReadyLabelsMap}},
+		{time.Now(), []string{notReadyPing}},
+	}
+
+	for _, tc := range tcs {
+		refreshed := int64(0)
+		if !tc.refreshed.IsZero() {
+			refreshed = tc.refreshed.UnixNano()
+		}
+		atomic.StoreInt64(&labelsRefreshed, refreshed)
+		reasons := checkReadiness(context.Background(), db)
+		if !reflect.DeepEqual(reasons, tc.reasons) {
+			t.Errorf("Invalid reasons for a refresh at %s: %v, expected: %v", tc.refreshed, reasons, tc.reasons)
+		}
+
+		if v := testutil.ToFloat64(ready); v != 0 {
+			t.Errorf("Invalid ready metric: %v, expected: 0", v)
+		}
+		for _, reason := range []string{notReadyPing, notReadyMetaTable, notReadyLabelsMap} {
+			e := 0.0
+			for _, r := range tc.reasons {
+				if r == reason {
+					e = 1
+				}
+			}
+			if v := testutil.ToFloat64(readinessFailing.WithLabelValues(reason)); v != e {
+				t.Errorf("Invalid failing metric for %s: %v, expected: %v", reason, v, e)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	readyHandler(db).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Invalid status: %d, expected: %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
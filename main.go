@@ -1,61 +1,118 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"database/sql"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
-	"strings"
-)
-
-// TODO: Something real with env vars and files and stuff
-type config struct {
-	dbURL           string
-	metricWhitelist string
-}
+	"os"
+	"os/signal"
+	"syscall"
 
-// TODO: allow regexes, or at least startswiths
-var defaultMetricWhitelist string = strings.Join(defaultMetrics, ",")
+	"github.com/pkg/errors"
+)
 
+// metrics ingested without an entry in the meta table, which includes the
+// adapter's own metrics
 var defaultMetrics []string = []string{
 	"up",
-	"monetdb_adapter_http_read_response_size_bytes_bucket",
-	"monetdb_adapter_http_read_response_size_bytes_sum",
-	"monetdb_adapter_http_read_response_size_bytes_count",
-	"monetdb_adapter_http_request_duration_seconds_bucket",
-	"monetdb_adapter_http_request_duration_seconds_sum",
-	"monetdb_adapter_http_request_duration_seconds_count",
-	"monetdb_adapter_http_requests_total",
-	"monetdb_adapter_http_write_response_size_bytes_bucket",
-	"monetdb_adapter_http_write_response_size_bytes_sum",
-	"monetdb_adapter_http_write_response_size_bytes_count",
-	"monetdb_adapter_queries_total",
-	"monetdb_adapter_query_errors_total",
-	"monetdb_adapter_reads_inflight",
-	"monetdb_adapter_row_errors_total",
-	"monetdb_adapter_rows_inserted_total",
-	"monetdb_adapter_rows_read_total",
-	"monetdb_adapter_rowscan_errors_total",
-	"monetdb_adapter_tables_created_total",
-	"monetdb_adapter_writes_inflight",
-	"monetdb_adapter_open_connections_total",
+	"monetdb.*",
 }
 
 func main() {
-	conf := config{}
-	flag.StringVar(&conf.dbURL, "dbURL", "monetdb:monetdb@monetdb:50000/db", "url for the MonetDB connection")
-	flag.StringVar(&conf.metricWhitelist, "whitelist", defaultMetricWhitelist, "comma-separated list of metric names to ingest by default, you can also insert lines into the db manually")
-	flag.Parse()
+	conf, err := loadConfig(os.Args[0], os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if conf.printConfig {
+		out, err := conf.marshal()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	partitionInterval = conf.DB.PartitionInterval
+	rollupsEnabled = conf.Rollups.Enabled
+	pushdownEnabled = conf.Read.Pushdown
+
+	db, err := initDB(&conf.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = applyConfig(db, conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// each listener only serves its own endpoints
+	apiMux := http.NewServeMux()
+	metricsMux := newMetricsMux()
+
+	bg := newBackground()
+	startDBRefresh(bg, db)
+	startHealth(bg, db, apiMux, metricsMux)
 
-	db, err := initDB(conf.dbURL, conf.metricWhitelist)
+	metricsServer := initMetrics(conf.Listen.MetricsAddress, metricsMux)
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	startReloader(bg, newReloader(db, conf, os.Args[0], os.Args[1:], os.Getenv), apiMux)
+
+	startRetention(bg, db, conf.Retention.Interval)
+	startRollups(bg, db, conf.Rollups.Interval)
+	initRead(apiMux, db)
+	queue := newWriteQueue(db, conf.Write.BatchSize, conf.Write.FlushInterval, conf.Write.QueueSize, conf.Write.Workers)
+	initWrite(apiMux, queue)
+
+	server := &http.Server{Addr: conf.Listen.Address, Handler: authenticate(apiMux)}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("received %s, shutting down", sig)
+	}
+	signal.Stop(stop)
+
+	err = shutdown(db, server, metricsServer, queue, bg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	log.Printf("shut down cleanly")
+}
 
-	initMetrics(":8080")
-	initRead(db)
-	initWrite(db)
+// shutdown stops accepting requests, waits for running requests and queued
+// samples, stops the background goroutines and closes the db, giving up on
+// waiting once the shutdown timeout is over.
+func shutdown(db *sql.DB, server *http.Server, metricsServer *http.Server, queue *writeQueue, bg *background) error {
+	ctx, cancel := context.WithTimeout(context.Background(), currentSettings().shutdownTimeout)
+	defer cancel()
 
-	http.ListenAndServe(":1234", nil)
+	failed := false
+	check := func(step string, err error) {
+		if err != nil {
+			log.Printf("error %s: %s", step, err)
+			failed = true
+		}
+	}
+
+	// waits for the in-flight reads and writes
+	check("stopping the HTTP server", server.Shutdown(ctx))
+	check("draining the write queue", queue.drain(ctx))
+	check("stopping background tasks", bg.stop(ctx))
+	check("stopping the metrics server", metricsServer.Shutdown(ctx))
+	check("closing the db", db.Close())
+
+	if failed {
+		return errors.New("shutdown didn't finish cleanly")
+	}
+	return nil
 }
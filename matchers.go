@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// maximum number of strings a regex may expand to before it's no longer
+// worth turning into an IN (...) list
+const maxLiteralSet = 64
+
+// labelFilter is a regex matcher that can't be expressed in SQL, so it is
+// applied to the label values of the rows that come back instead.
+type labelFilter struct {
+	label  string
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (f *labelFilter) matches(value string) bool {
+	return f.re.MatchString(value) != f.negate
+}
+
+// compileAnchored compiles a regex with the fully anchored semantics Prometheus uses.
+func compileAnchored(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// regexCondition translates a Prometheus regex matcher on a label column into a
+// SQL condition and its parameters. Patterns that only match a handful of
+// literal strings become = or IN (...), patterns made of literals and wildcards
+// become LIKE, and anything else is returned as a labelFilter to apply to the
+// rows in Go. An empty condition means the column doesn't need to be checked in SQL.
+func regexCondition(column, label, pattern string, negate bool) (string, []interface{}, *labelFilter, error) {
+	re, err := compileAnchored(pattern)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	parsed = stripAnchors(parsed.Simplify())
+
+	if literals, ok := literalSet(parsed); ok {
+		cond, args := literalCondition(column, literals, negate)
+		return cond, args, nil, nil
+	}
+
+	if like, ok := likePattern(parsed); ok {
+		if like == "%" {
+			// matches everything
+			if negate {
+				return "1 = 0", nil, nil, nil
+			}
+			return "", nil, nil, nil
+		}
+
+		op := "LIKE"
+		if negate {
+			op = "NOT LIKE"
+		}
+		return fmt.Sprintf("%s %s ? ESCAPE '#'", column, op), []interface{}{like}, nil, nil
+	}
+
+	return "", nil, &labelFilter{label: label, re: re, negate: negate}, nil
+}
+
+// stripAnchors removes a leading ^ and trailing $, which are redundant as
+// Prometheus anchors every regex anyway.
+func stripAnchors(re *syntax.Regexp) *syntax.Regexp {
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 {
+		return re
+	}
+
+	sub := re.Sub
+	if sub[0].Op == syntax.OpBeginText {
+		sub = sub[1:]
+	}
+	if len(sub) > 0 && sub[len(sub)-1].Op == syntax.OpEndText {
+		sub = sub[:len(sub)-1]
+	}
+
+	stripped := *re
+	stripped.Sub = sub
+	return &stripped
+}
+
+func literalCondition(column string, literals []string, negate bool) (string, []interface{}) {
+	switch len(literals) {
+	case 0:
+		// matches nothing
+		if negate {
+			return "", nil
+		}
+		return "1 = 0", nil
+	case 1:
+		op := "="
+		if negate {
+			op = "!="
+		}
+		return fmt.Sprintf("%s %s ?", column, op), []interface{}{literals[0]}
+	}
+
+	placeholders := make([]string, len(literals))
+	args := make([]interface{}, len(literals))
+	for i, l := range literals {
+		placeholders[i] = "?"
+		args[i] = l
+	}
+
+	op := "IN"
+	if negate {
+		op = "NOT IN"
+	}
+	return fmt.Sprintf("%s %s (%s)", column, op, strings.Join(placeholders, ", ")), args
+}
+
+// literalSet returns every string a regex can match, provided there are few
+// enough of them and the regex is case sensitive.
+func literalSet(re *syntax.Regexp) ([]string, bool) {
+	if re.Flags&syntax.FoldCase != 0 {
+		return nil, false
+	}
+
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return []string{}, true
+
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}, true
+
+	case syntax.OpCharClass:
+		set := []string{}
+		for i := 0; i < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(set) >= maxLiteralSet {
+					return nil, false
+				}
+				set = append(set, string(r))
+			}
+		}
+		return set, true
+
+	case syntax.OpCapture:
+		return literalSet(re.Sub[0])
+
+	case syntax.OpQuest:
+		set, ok := literalSet(re.Sub[0])
+		if !ok {
+			return nil, false
+		}
+		return appendUnique([]string{""}, set...), true
+
+	case syntax.OpAlternate:
+		set := []string{}
+		for _, sub := range re.Sub {
+			subSet, ok := literalSet(sub)
+			if !ok {
+				return nil, false
+			}
+			set = appendUnique(set, subSet...)
+			if len(set) > maxLiteralSet {
+				return nil, false
+			}
+		}
+		return set, true
+
+	case syntax.OpConcat:
+		set := []string{""}
+		for _, sub := range re.Sub {
+			subSet, ok := literalSet(sub)
+			if !ok || len(set)*len(subSet) > maxLiteralSet {
+				return nil, false
+			}
+			product := []string{}
+			for _, prefix := range set {
+				for _, suffix := range subSet {
+					product = appendUnique(product, prefix+suffix)
+				}
+			}
+			set = product
+		}
+		return set, true
+	}
+
+	return nil, false
+}
+
+func appendUnique(set []string, strs ...string) []string {
+	for _, s := range strs {
+		found := false
+		for _, existing := range set {
+			if existing == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			set = append(set, s)
+		}
+	}
+	return set
+}
+
+// likePattern turns a regex made of literals and . or .* into a LIKE pattern
+// that uses # as its escape character. Note that unlike . in a regex, the LIKE
+// wildcards also match newlines.
+func likePattern(re *syntax.Regexp) (string, bool) {
+	parts := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		parts = re.Sub
+	}
+
+	var like strings.Builder
+	for _, part := range parts {
+		if part.Op == syntax.OpCapture {
+			part = part.Sub[0]
+		}
+
+		switch {
+		case part.Op == syntax.OpLiteral && part.Flags&syntax.FoldCase == 0:
+			like.WriteString(escapeLike(string(part.Rune)))
+		case isAnyChar(part):
+			like.WriteString("_")
+		case part.Op == syntax.OpStar && isAnyChar(part.Sub[0]):
+			like.WriteString("%")
+		case part.Op == syntax.OpPlus && isAnyChar(part.Sub[0]):
+			like.WriteString("_%")
+		case part.Op == syntax.OpEmptyMatch:
+		default:
+			return "", false
+		}
+	}
+
+	return like.String(), true
+}
+
+func isAnyChar(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpAnyChar || re.Op == syntax.OpAnyCharNotNL
+}
+
+func escapeLike(str string) string {
+	str = strings.Replace(str, "#", "##", -1)
+	str = strings.Replace(str, "%", "#%", -1)
+	return strings.Replace(str, "_", "#_", -1)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegexCondition(t *testing.T) {
+	tcs := []struct {
+		pattern string
+		negate  bool
+		cond    string
+		args    []interface{}
+		filter  bool
+	}{
+		{"foo", false, `"job" = ?`, []interface{}{"foo"}, false},
+		{"foo", true, `"job" != ?`, []interface{}{"foo"}, false},
+		{"^foo$", false, `"job" = ?`, []interface{}{"foo"}, false},
+		{"foo|bar", false, `"job" IN (?, ?)`, []interface{}{"foo", "bar"}, false},
+		{"foo|bar", true, `"job" NOT IN (?, ?)`, []interface{}{"foo", "bar"}, false},
+		{"api-(1|2)", false, `"job" IN (?, ?)`, []interface{}{"api-1", "api-2"}, false},
+		{"a|b|c", false, `"job" IN (?, ?, ?)`, []interface{}{"a", "b", "c"}, false},
+		{"foo.*", false, `"job" LIKE ? ESCAPE '#'`, []interface{}{"foo%"}, false},
+		{".*foo", false, `"job" LIKE ? ESCAPE '#'`, []interface{}{"%foo"}, false},
+		{".*foo.*", true, `"job" NOT LIKE ? ESCAPE '#'`, []interface{}{"%foo%"}, false},
+		{"foo.+", false, `"job" LIKE ? ESCAPE '#'`, []interface{}{"foo_%"}, false},
+		{"node_.*", false, `"job" LIKE ? ESCAPE '#'`, []interface{}{"node#_%"}, false},
+		{"it's.*", false, `"job" LIKE ? ESCAPE '#'`, []interface{}{"it's%"}, false},
+		{".*", false, "", nil, false},
+		{".*", true, "1 = 0", nil, false},
+		{"", false, `"job" = ?`, []interface{}{""}, false},
+		{"(?i)foo", false, "", nil, true},
+		{"[0-9]+", false, "", nil, true},
+		{"foo.*bar|baz", true, "", nil, true},
+	}
+
+	for _, tc := range tcs {
+		cond, args, filter, err := regexCondition(`"job"`, "job", tc.pattern, tc.negate)
+		if err != nil {
+			t.Errorf("Error translating %q: %v", tc.pattern, err)
+			continue
+		}
+		if cond != tc.cond {
+			t.Errorf("Invalid condition for %q: %s, expected: %s", tc.pattern, cond, tc.cond)
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("Invalid args for %q: %v, expected: %v", tc.pattern, args, tc.args)
+		}
+		if (filter != nil) != tc.filter {
+			t.Errorf("Invalid filter for %q: %v, expected filter: %v", tc.pattern, filter, tc.filter)
+		}
+	}
+
+	if _, _, _, err := regexCondition(`"job"`, "job", "(", false); err == nil {
+		t.Errorf("Expected an error for an invalid regex")
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	_, _, filter, err := regexCondition(`"job"`, "job", "(?i)api-[0-9]+", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := map[string]bool{
+		"api-1":     true,
+		"API-42":    true,
+		"api-":      false,
+		"my-api-1":  false,
+		"api-1-foo": false,
+	}
+	for value, expected := range tcs {
+		if filter.matches(value) != expected {
+			t.Errorf("Invalid match for %q, expected: %v", value, expected)
+		}
+	}
+
+	filter.negate = true
+	if filter.matches("api-1") {
+		t.Errorf("Negated filter matched")
+	}
+}
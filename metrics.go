@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"net/http/pprof"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -66,6 +67,67 @@ var writeInFlight prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
 	Help: "Number of current HTTP read requests happening.",
 })
 
+var queueDepth prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "monetdb_adapter_write_queue_samples",
+	Help: "Number of samples waiting in the write queue to be flushed to MonetDB.",
+})
+
+var flushDuration prometheus.Histogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "monetdb_adapter_write_flush_duration_seconds",
+	Help:    "A histogram of latencies for flushing a batch of samples to MonetDB.",
+	Buckets: []float64{.01, .05, .1, .15, .25, .5, 1, 2.5, 5, 10, 20, 30, 45, 60},
+})
+
+var flushErrors prometheus.Counter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_write_flush_errors_total",
+		Help: "Number of batches that failed to be flushed to MonetDB.",
+	})
+
+var flushRetries prometheus.Counter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_write_flush_retries_total",
+		Help: "Number of times flushing a batch of samples to MonetDB was retried.",
+	})
+
+var samplesDropped prometheus.Counter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_samples_dropped_total",
+		Help: "Number of queued samples dropped because their batch failed to flush after every retry.",
+	})
+
+var retentionRowsDeleted prometheus.Counter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_retention_rows_deleted_total",
+		Help: "Number of rows deleted from MonetDB because they were older than their retention.",
+	})
+
+var retentionRunDuration prometheus.Histogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "monetdb_adapter_retention_run_duration_seconds",
+	Help:    "A histogram of latencies for applying retention to every metric table.",
+	Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+})
+
+var rollupRowsInserted prometheus.Counter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_rollup_rows_inserted_total",
+		Help: "Number of aggregated rows inserted into rollup tables.",
+	})
+
+var rollupRunDuration prometheus.Histogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "monetdb_adapter_rollup_run_duration_seconds",
+	Help:    "A histogram of latencies for rolling up new samples of every metric table.",
+	Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+})
+
+var rollupReads *prometheus.CounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_rollup_reads_total",
+		Help: "Number of metric reads served from rollup tables.",
+	},
+	[]string{"resolution"},
+)
+
 var requestsCounter *prometheus.CounterVec = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "monetdb_adapter_http_requests_total",
@@ -101,16 +163,82 @@ var writeResponseSize *prometheus.HistogramVec = prometheus.NewHistogramVec(
 	[]string{},
 )
 
-func initMetrics(addr string) {
-	prometheus.MustRegister(rowsInserted, rowsRead, queryErrors, rowScanErrors, rowErrors, dbQueries, openConns, tablesCreated, readInFlight, writeInFlight, requestsCounter, requestDuration, readResponseSize, writeResponseSize)
+var configReloadSuccess prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "monetdb_adapter_config_last_reload_successful",
+	Help: "Whether the last config reload succeeded.",
+})
+
+var configReloadSeconds prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "monetdb_adapter_config_last_reload_success_timestamp_seconds",
+	Help: "Timestamp of the last successful config reload.",
+})
+
+var relabelSeries *prometheus.CounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_relabel_series_total",
+		Help: "Number of incoming series kept or dropped by each relabel rule.",
+	},
+	[]string{"rule", "result"},
+)
+
+var labelsRefreshFailures *prometheus.CounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_labels_map_refresh_failures_total",
+		Help: "Number of failed refreshes of the labels map from the meta table, by the step that failed.",
+	},
+	[]string{"reason"},
+)
+
+var labelsRefreshSeconds prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "monetdb_adapter_labels_map_last_refresh_success_timestamp_seconds",
+	Help: "Timestamp of the last successful refresh of the labels map.",
+})
+
+var ready prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "monetdb_adapter_ready",
+	Help: "Whether the last readiness check succeeded.",
+})
+
+var readinessFailing *prometheus.GaugeVec = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "monetdb_adapter_readiness_check_failing",
+		Help: "Whether each part of the last readiness check failed.",
+	},
+	[]string{"reason"},
+)
+
+var authFailures *prometheus.CounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "monetdb_adapter_auth_failures_total",
+		Help: "Number of requests rejected for missing or invalid credentials, by endpoint group and reason.",
+	},
+	[]string{"endpoint", "reason"},
+)
+
+// newMetricsMux returns a mux serving the adapter's own metrics and the pprof
+// endpoints, which stay off the API listener
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func initMetrics(addr string, mux *http.ServeMux) *http.Server {
+	prometheus.MustRegister(rowsInserted, rowsRead, queryErrors, rowScanErrors, rowErrors, dbQueries, openConns, tablesCreated, readInFlight, writeInFlight, requestsCounter, requestDuration, readResponseSize, writeResponseSize, queueDepth, flushDuration, flushErrors, flushRetries, samplesDropped, retentionRowsDeleted, retentionRunDuration, rollupRowsInserted, rollupRunDuration, rollupReads, configReloadSuccess, configReloadSeconds, relabelSeries, labelsRefreshFailures, labelsRefreshSeconds, ready, readinessFailing, authFailures)
 
+	server := &http.Server{Addr: addr, Handler: authenticate(mux)}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
 		log.Printf("exposing prometheus metrics at %s", addr)
 
-		err := http.ListenAndServe(addr, nil)
-		if err != nil {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
+	return server
 }
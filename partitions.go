@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	//_ "github.com/fajran/go-monetdb"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// time range covered by each partition of a metric table, 0 disables partitioning
+var partitionInterval time.Duration
+
+// partition tables we know exist
+var knownPartitions = map[string]bool{}
+
+// serializes partition creation so only one writer creates a given partition
+var partitionLock sync.Mutex
+
+var addPartitionQuery string = `
+ALTER TABLE %s ADD TABLE %s AS PARTITION FROM %d TO %d;`
+
+var detachPartitionQuery string = `
+ALTER TABLE %s DROP TABLE %s;`
+
+var dropTableQuery string = `
+DROP TABLE %s;`
+
+var countRowsQuery string = `
+SELECT COUNT(*) FROM %s;`
+
+// partitions are found through the partition catalog, as a metric table may
+// look just like a partition of another metric
+var selectPartitionsQuery string = `
+SELECT p.name, rp.minimum, rp.maximum FROM sys.range_partitions rp, sys.table_partitions tp, sys.tables m, sys.tables p WHERE rp.partition_id = tp.id AND tp.table_id = m.id AND rp.table_id = p.id AND m.name = ?;`
+
+// partition is a table attached to the merge table of a metric, holding the
+// samples from start up to end
+type partition struct {
+	table string
+	start int64
+	end   int64
+}
+
+// partitionStart returns the start in milliseconds of the partition a timestamp falls into
+func partitionStart(timestamp int64) int64 {
+	return bucketStart(timestamp, int64(partitionInterval/time.Millisecond))
+}
+
+// partitionName returns the name of the partition table of a metric starting at start
+func partitionName(name string, start int64) string {
+	return fmt.Sprintf("%s_p%d", name, start)
+}
+
+// metricPartitions returns the partitions attached to the merge table of a metric
+func metricPartitions(db *sql.DB, name string) ([]partition, error) {
+	rows, err := db.Query(selectPartitionsQuery, name)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return nil, errors.Wrap(err, "select partitions query")
+	}
+	defer rows.Close()
+
+	var table, minimum, maximum string
+	partitions := []partition{}
+	for rows.Next() {
+		err = rows.Scan(&table, &minimum, &maximum)
+		if err != nil {
+			rowScanErrors.Inc()
+			return nil, errors.Wrap(err, "scan partition rows")
+		}
+		rowsRead.Inc()
+
+		p := partition{table: table}
+		p.start, err = strconv.ParseInt(minimum, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid start of partition %s", table)
+		}
+		p.end, err = strconv.ParseInt(maximum, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid end of partition %s", table)
+		}
+		partitions = append(partitions, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return nil, errors.Wrap(err, "partition row")
+	}
+	return partitions, nil
+}
+
+// copyTargets returns the tables the samples of a metric are copied into,
+// creating the partitions they fall into if the metric is partitioned.
+func copyTargets(db *sql.DB, name string, samples model.Samples) (map[string]model.Samples, error) {
+	if partitionInterval <= 0 {
+		return map[string]model.Samples{name: samples}, nil
+	}
+
+	partitions := map[int64]model.Samples{}
+	for _, sample := range samples {
+		start := partitionStart(int64(sample.Timestamp))
+		partitions[start] = append(partitions[start], sample)
+	}
+
+	targets := make(map[string]model.Samples, len(partitions))
+	for start, partitionSamples := range partitions {
+		partition, err := getPartitionOrCreate(db, name, start)
+		if err != nil {
+			return nil, err
+		}
+		targets[partition] = partitionSamples
+	}
+	return targets, nil
+}
+
+// getPartitionOrCreate returns the name of the partition of a metric starting
+// at start, creating it and attaching it to the metric's merge table if needed.
+func getPartitionOrCreate(db *sql.DB, name string, start int64) (string, error) {
+	partition := partitionName(name, start)
+
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+
+	if knownPartitions[partition] {
+		return partition, nil
+	}
+
+	partitions, err := metricPartitions(db, name)
+	if err != nil {
+		return "", err
+	}
+	exists := false
+	for _, p := range partitions {
+		if p.table == partition {
+			exists = true
+		}
+	}
+	if !exists {
+		err = createPartition(db, name, partition, start)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	knownPartitions[partition] = true
+	return partition, nil
+}
+
+func createPartition(db *sql.DB, name string, partition string, start int64) error {
+	tableCreateLock.Lock()
+	defer tableCreateLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+
+	// partitions need the same columns as their merge table
+	query := fmt.Sprintf(createTableQuery, monetdb.QuoteIdentifier(partition), metricTableColumns(splitLabels(currentLabelsMap()[name])))
+	_, err = tx.Exec(query)
+	if err != nil {
+		tx.Rollback()
+		queryErrors.Inc()
+		return errors.Wrap(err, "create partition table")
+	}
+
+	end := start + int64(partitionInterval/time.Millisecond)
+	_, err = tx.Exec(fmt.Sprintf(addPartitionQuery, monetdb.QuoteIdentifier(name), monetdb.QuoteIdentifier(partition), start, end))
+	if err != nil {
+		tx.Rollback()
+		queryErrors.Inc()
+		return errors.Wrap(err, "add partition to merge table")
+	}
+
+	err = tx.Commit()
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transaction")
+	}
+	tablesCreated.Inc()
+	log.Printf("created partition %s of table %s", partition, name)
+
+	return nil
+}
+
+// dropOldPartitions drops the partitions of a metric that only hold samples
+// older than the cutoff and returns how many rows they held, only counting
+// them when dryRun is set.
+func dropOldPartitions(db *sql.DB, name string, cutoff int64, dryRun bool) (int64, error) {
+	partitions, err := metricPartitions(db, name)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := int64(0)
+	for _, p := range partitions {
+		if p.end > cutoff {
+			continue
+		}
+
+		var count int64
+		err := db.QueryRow(fmt.Sprintf(countRowsQuery, monetdb.QuoteIdentifier(p.table))).Scan(&count)
+		dbQueries.Inc()
+		if err != nil {
+			queryErrors.Inc()
+			return deleted, errors.Wrapf(err, "count rows of partition %s", p.table)
+		}
+
+		if !dryRun {
+			err = dropPartition(db, name, p.table)
+			if err != nil {
+				return deleted, err
+			}
+		}
+		deleted += count
+	}
+
+	return deleted, nil
+}
+
+func dropPartition(db *sql.DB, name string, partition string) error {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(detachPartitionQuery, monetdb.QuoteIdentifier(name), monetdb.QuoteIdentifier(partition)))
+	if err != nil {
+		tx.Rollback()
+		queryErrors.Inc()
+		return errors.Wrapf(err, "detach partition %s", partition)
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(dropTableQuery, monetdb.QuoteIdentifier(partition)))
+	if err != nil {
+		tx.Rollback()
+		queryErrors.Inc()
+		return errors.Wrapf(err, "drop partition %s", partition)
+	}
+
+	err = tx.Commit()
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transaction")
+	}
+
+	delete(knownPartitions, partition)
+	log.Printf("dropped partition %s of table %s", partition, name)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitionStart(t *testing.T) {
+	partitionInterval = 24 * time.Hour
+	defer func() { partitionInterval = 0 }()
+
+	day := int64(24 * time.Hour / time.Millisecond)
+	tcs := map[int64]int64{
+		0:           0,
+		1:           0,
+		day - 1:     0,
+		day:         day,
+		3*day + 42:  3 * day,
+		-1:          -day,
+		-day:        -day,
+		-day - 1:    -2 * day,
+		10*day - 10: 9 * day,
+	}
+	for timestamp, expected := range tcs {
+		if start := partitionStart(timestamp); start != expected {
+			t.Errorf("Invalid partition start for %d: %d, expected: %d", timestamp, start, expected)
+		}
+	}
+}
+
+func TestPartitionName(t *testing.T) {
+	if name := partitionName("up", 86400000); name != "up_p86400000" {
+		t.Errorf("Invalid partition name: %s", name)
+	}
+}
+
+func TestAddLabelsToPartitionedMetric(t *testing.T) {
+	partitions := []partition{
+		{table: "up_p0", start: 0, end: 1000},
+		{table: "up_p1000", start: 1000, end: 2000},
+	}
+
+	queries := addLabelsQueries("up", partitions, []string{"job", "env"})
+	for i := range queries {
+		queries[i] = strings.TrimSpace(queries[i])
+	}
+
+	e := []string{
+		`ALTER TABLE "up" DROP TABLE "up_p0";`,
+		`ALTER TABLE "up" DROP TABLE "up_p1000";`,
+		`ALTER TABLE "up" ADD COLUMN "job" VARCHAR(120) DEFAULT NULL;`,
+		`ALTER TABLE "up" ADD COLUMN "env" VARCHAR(120) DEFAULT NULL;`,
+		`ALTER TABLE "up_p0" ADD COLUMN "job" VARCHAR(120) DEFAULT NULL;`,
+		`ALTER TABLE "up_p0" ADD COLUMN "env" VARCHAR(120) DEFAULT NULL;`,
+		`ALTER TABLE "up_p1000" ADD COLUMN "job" VARCHAR(120) DEFAULT NULL;`,
+		`ALTER TABLE "up_p1000" ADD COLUMN "env" VARCHAR(120) DEFAULT NULL;`,
+		`ALTER TABLE "up" ADD TABLE "up_p0" AS PARTITION FROM 0 TO 1000;`,
+		`ALTER TABLE "up" ADD TABLE "up_p1000" AS PARTITION FROM 1000 TO 2000;`,
+	}
+	if !reflect.DeepEqual(queries, e) {
+		t.Errorf("Invalid queries: %q, expected: %q", queries, e)
+	}
+
+	// unpartitioned metrics only alter their table
+	queries = addLabelsQueries("up", nil, []string{"job"})
+	if len(queries) != 1 || strings.TrimSpace(queries[0]) != `ALTER TABLE "up" ADD COLUMN "job" VARCHAR(120) DEFAULT NULL;` {
+		t.Errorf("Invalid queries: %q", queries)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var pushdownEnabled bool
+
+// pushdownAggregate returns the SQL aggregate that can replace the raw samples
+// of each step of a query without changing the result of the function in its
+// hints, or false if the function needs every raw sample.
+//
+// Only functions that give the same result when applied to partial results
+// of themselves qualify: the max of per-step maxima is the max of the samples,
+// but neither the average of averages nor the rate between per-step samples
+// equals its raw counterpart. The hints of the Prometheus version we build
+// against don't carry the range of range vectors, so the result is only exact
+// if the range equals the step, as with Grafana's $__interval. That can't be
+// checked, which is why pushdown has to be enabled explicitly.
+func pushdownAggregate(hints *prompb.ReadHints) (string, bool) {
+	if !pushdownEnabled || hints == nil || hints.StepMs <= 0 {
+		return "", false
+	}
+
+	switch hints.Func {
+	case "max_over_time":
+		return "MAX", true
+	case "min_over_time":
+		return "MIN", true
+	case "sum_over_time":
+		return "SUM", true
+	}
+	return "", false
+}
+
+// pushdownBucket returns the expression for the end of the step a row falls
+// into. With a range equal to the step, the first evaluation timestamp is a
+// step after the start of the query, and each one covers the samples in
+// (t-step, t].
+func pushdownBucket(q *prompb.Query, src metricSource) string {
+	start := q.StartTimestampMs - src.offset
+	step := q.Hints.StepMs
+	return fmt.Sprintf(`%d + ("timestamp" - %d + %d) / %d * %d`, start, start, step-1, step, step)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	errQueueFull   = errors.New("write queue is full")
+	errQueueClosed = errors.New("write queue is closed")
+)
+
+// failed flushes are retried with exponential backoff, as their samples have
+// already been acknowledged and would be lost otherwise
+const maxFlushAttempts = 4
+
+var flushRetryBackoff = time.Second
+
+// writeBatch is a set of samples destined for a single metric table.
+type writeBatch struct {
+	table   string
+	samples model.Samples
+}
+
+// pendingBatch accumulates samples for a table until it is flushed.
+type pendingBatch struct {
+	samples model.Samples
+	created time.Time
+}
+
+// writeQueue buffers incoming samples per metric table and hands them off to
+// a pool of writer goroutines once a table's batch is big enough or old enough.
+type writeQueue struct {
+	// writes a batch of samples to the db
+	write         func(context.Context, model.Samples) error
+	batchSize     int
+	flushInterval time.Duration
+	capacity      int
+
+	mtx     sync.Mutex
+	pending map[string]*pendingBatch
+	depth   int
+	closed  bool
+
+	batches chan *writeBatch
+	// handoffs counts the batches being sent to the writers outside of the lock
+	handoffs sync.WaitGroup
+	writers  sync.WaitGroup
+
+	stop       chan struct{}
+	tickerDone chan struct{}
+	// abort is closed when drain gives up, cutting retry backoffs short
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+func newWriteQueue(db *sql.DB, batchSize int, flushInterval time.Duration, capacity int, workers int) *writeQueue {
+	q := &writeQueue{
+		write: func(ctx context.Context, samples model.Samples) error {
+			return writeSamples(ctx, db, samples)
+		},
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		capacity:      capacity,
+		pending:       map[string]*pendingBatch{},
+		batches:       make(chan *writeBatch, workers),
+		stop:          make(chan struct{}),
+		tickerDone:    make(chan struct{}),
+		abort:         make(chan struct{}),
+	}
+
+	q.writers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.runWriter()
+	}
+
+	// flush batches that have been sitting around for too long
+	go func() {
+		defer close(q.tickerDone)
+		ticker := time.NewTicker(flushInterval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				q.flushOld()
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+
+	return q
+}
+
+// enqueue adds samples to the queue, refusing them entirely if doing so would
+// take the queue over capacity so the sender can retry later. An empty queue
+// takes any number of samples, otherwise a request bigger than the capacity
+// would be refused on every retry.
+func (q *writeQueue) enqueue(samples model.Samples) error {
+	q.mtx.Lock()
+	if q.closed {
+		q.mtx.Unlock()
+		return errQueueClosed
+	}
+	if q.depth > 0 && q.depth+len(samples) > q.capacity {
+		q.mtx.Unlock()
+		return errQueueFull
+	}
+
+	full := []*writeBatch{}
+	for _, sample := range samples {
+		name, hasName := sample.Metric[model.MetricNameLabel]
+		if !hasName {
+			continue
+		}
+		table := string(name)
+
+		p, exists := q.pending[table]
+		if !exists {
+			p = &pendingBatch{created: time.Now()}
+			q.pending[table] = p
+		}
+		p.samples = append(p.samples, sample)
+		q.depth++
+
+		if len(p.samples) >= q.batchSize {
+			full = append(full, &writeBatch{table: table, samples: p.samples})
+			delete(q.pending, table)
+		}
+	}
+	queueDepth.Set(float64(q.depth))
+	q.handoffs.Add(1)
+	q.mtx.Unlock()
+
+	// hand off outside of the lock so a busy writer pool doesn't block other
+	// enqueues. The request itself waits until a writer takes its full
+	// batches, which is the backpressure that slows down senders.
+	q.handOff(full)
+	return nil
+}
+
+// handOff sends batches to the writers and marks the hand off as done
+func (q *writeQueue) handOff(batches []*writeBatch) {
+	defer q.handoffs.Done()
+	for _, b := range batches {
+		q.batches <- b
+	}
+}
+
+// flushOld sends every pending batch older than the flush interval to the writers.
+func (q *writeQueue) flushOld() {
+	q.flush(func(p *pendingBatch) bool {
+		return time.Since(p.created) >= q.flushInterval
+	})
+}
+
+// flush sends every pending batch for which send returns true to the writers.
+func (q *writeQueue) flush(send func(p *pendingBatch) bool) {
+	q.mtx.Lock()
+	batches := []*writeBatch{}
+	for table, p := range q.pending {
+		if send(p) {
+			batches = append(batches, &writeBatch{table: table, samples: p.samples})
+			delete(q.pending, table)
+		}
+	}
+	q.handoffs.Add(1)
+	q.mtx.Unlock()
+
+	q.handOff(batches)
+}
+
+// drain stops accepting samples and flushes everything still queued, waiting
+// for the writers to finish or for ctx to be done.
+func (q *writeQueue) drain(ctx context.Context) error {
+	q.mtx.Lock()
+	q.closed = true
+	q.mtx.Unlock()
+
+	close(q.stop)
+	<-q.tickerDone
+
+	done := make(chan struct{})
+	go func() {
+		// no more hand offs can start once the queue is closed and the ticker stopped
+		q.handoffs.Wait()
+		q.flush(func(*pendingBatch) bool { return true })
+		close(q.batches)
+		q.writers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.abortOnce.Do(func() { close(q.abort) })
+		return errors.Wrapf(ctx.Err(), "%d samples left in the write queue", q.queued())
+	}
+}
+
+// queued returns the number of samples waiting to be written
+func (q *writeQueue) queued() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.depth
+}
+
+func (q *writeQueue) runWriter() {
+	defer q.writers.Done()
+	for b := range q.batches {
+		err := q.flushBatch(b)
+		if err != nil {
+			flushErrors.Inc()
+			samplesDropped.Add(float64(len(b.samples)))
+			log.Printf("error flushing %d samples to %s, dropping them: %s", len(b.samples), b.table, err)
+		}
+
+		q.mtx.Lock()
+		q.depth -= len(b.samples)
+		queueDepth.Set(float64(q.depth))
+		q.mtx.Unlock()
+	}
+}
+
+// flushBatch writes a batch to the db, retrying up to maxFlushAttempts times
+// unless the queue is aborted while it backs off
+func (q *writeQueue) flushBatch(b *writeBatch) error {
+	backoff := flushRetryBackoff
+	for attempt := 1; ; attempt++ {
+		// samples are acknowledged once they're queued, so flushes aren't tied to the write request
+		ctx, cancel := timeoutContext(context.Background(), currentSettings().writeTimeout)
+		start := time.Now()
+		err := q.write(ctx, b.samples)
+		cancel()
+		flushDuration.Observe(time.Since(start).Seconds())
+		if err == nil || attempt == maxFlushAttempts {
+			return err
+		}
+
+		flushRetries.Inc()
+		log.Printf("error flushing %d samples to %s, retrying in %s: %s", len(b.samples), b.table, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-q.abort:
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestWriteQueueDrain(t *testing.T) {
+	defer func(backoff time.Duration) { flushRetryBackoff = backoff }(flushRetryBackoff)
+	flushRetryBackoff = time.Millisecond
+
+	// nothing listens there, so every flush attempt fails right away and the samples are dropped
+	db, err := sql.Open("monetdb", "monetdb:monetdb@localhost:1/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := newWriteQueue(db, 100, time.Hour, 100, 2)
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 1, Timestamp: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 2, Timestamp: 2},
+		{Metric: model.Metric{model.MetricNameLabel: "b"}, Value: 3, Timestamp: 1},
+	}
+	err = q.enqueue(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.queued() != 3 {
+		t.Errorf("Invalid number of queued samples: %d, expected: 3", q.queued())
+	}
+
+	dropped := testutil.ToFloat64(samplesDropped)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = q.drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending batches were flushed even though they weren't full or old
+	if q.queued() != 0 {
+		t.Errorf("Invalid number of queued samples after drain: %d, expected: 0", q.queued())
+	}
+	if v := testutil.ToFloat64(samplesDropped); v != dropped+3 {
+		t.Errorf("Invalid dropped count: %v, expected: %v", v, dropped+3)
+	}
+
+	err = q.enqueue(samples)
+	if err != errQueueClosed {
+		t.Errorf("Invalid error enqueuing after drain: %v, expected: %v", err, errQueueClosed)
+	}
+}
+
+func TestWriteQueueBatches(t *testing.T) {
+	q := newWriteQueue(nil, 2, time.Hour, 3, 1)
+	written := make(chan model.Samples, 2)
+	q.write = func(ctx context.Context, samples model.Samples) error {
+		written <- samples
+		return nil
+	}
+
+	err := q.enqueue(model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 1, Timestamp: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "b"}, Value: 1, Timestamp: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 2, Timestamp: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch of a is full, b waits for more samples
+	select {
+	case samples := <-written:
+		if len(samples) != 2 || samples[0].Metric[model.MetricNameLabel] != "a" {
+			t.Errorf("Invalid batch: %v", samples)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Full batch wasn't flushed")
+	}
+
+	// queued samples count against the capacity until they're written
+	err = q.enqueue(model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "b"}, Value: 2, Timestamp: 2},
+		{Metric: model.Metric{model.MetricNameLabel: "b"}, Value: 3, Timestamp: 3},
+		{Metric: model.Metric{model.MetricNameLabel: "b"}, Value: 4, Timestamp: 4},
+	})
+	if err != errQueueFull {
+		t.Errorf("Invalid error enqueuing over capacity: %v, expected: %v", err, errQueueFull)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = q.drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples := <-written; len(samples) != 1 || samples[0].Metric[model.MetricNameLabel] != "b" {
+		t.Errorf("Invalid batch: %v", samples)
+	}
+}
+
+func TestWriteQueueRetry(t *testing.T) {
+	defer func(backoff time.Duration) { flushRetryBackoff = backoff }(flushRetryBackoff)
+	flushRetryBackoff = time.Millisecond
+
+	tcs := []struct {
+		failures int
+		dropped  float64
+	}{
+		{maxFlushAttempts - 1, 0},
+		{maxFlushAttempts, 1},
+	}
+
+	for _, tc := range tcs {
+		q := newWriteQueue(nil, 1, time.Hour, 10, 1)
+
+		var mtx sync.Mutex
+		attempts := 0
+		q.write = func(ctx context.Context, samples model.Samples) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			attempts++
+			if attempts <= tc.failures {
+				return errors.New("transient error")
+			}
+			return nil
+		}
+
+		dropped := testutil.ToFloat64(samplesDropped)
+		err := q.enqueue(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 1, Timestamp: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = q.drain(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		eAttempts := tc.failures + 1
+		if eAttempts > maxFlushAttempts {
+			eAttempts = maxFlushAttempts
+		}
+		if attempts != eAttempts {
+			t.Errorf("Invalid number of attempts with %d failures: %d, expected: %d", tc.failures, attempts, eAttempts)
+		}
+		if v := testutil.ToFloat64(samplesDropped) - dropped; v != tc.dropped {
+			t.Errorf("Invalid number of dropped samples with %d failures: %v, expected: %v", tc.failures, v, tc.dropped)
+		}
+	}
+}
+
+func TestWriteQueueOversizedRequest(t *testing.T) {
+	q := newWriteQueue(nil, 2, time.Hour, 2, 1)
+	written := make(chan model.Samples, 3)
+	// the samples stay queued until the writer is released
+	release := make(chan struct{})
+	q.write = func(ctx context.Context, samples model.Samples) error {
+		<-release
+		written <- samples
+		return nil
+	}
+
+	samples := model.Samples{}
+	for i := 0; i < 5; i++ {
+		samples = append(samples, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 1, Timestamp: model.Time(i)})
+	}
+
+	// an empty queue takes more samples than its capacity, else they'd be refused forever
+	err := q.enqueue(samples)
+	if err != nil {
+		t.Fatalf("Invalid error enqueuing into an empty queue: %v", err)
+	}
+	err = q.enqueue(samples[:1])
+	if err != errQueueFull {
+		t.Errorf("Invalid error enqueuing over capacity: %v, expected: %v", err, errQueueFull)
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = q.drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(<-written) + len(<-written) + len(<-written); n != 5 {
+		t.Errorf("Invalid number of written samples: %d, expected: 5", n)
+	}
+}
+
+func TestWriteQueueDrainAbortsBackoff(t *testing.T) {
+	defer func(backoff time.Duration) { flushRetryBackoff = backoff }(flushRetryBackoff)
+	flushRetryBackoff = time.Hour
+
+	q := newWriteQueue(nil, 1, time.Hour, 10, 1)
+	q.write = func(ctx context.Context, samples model.Samples) error {
+		return errors.New("transient error")
+	}
+
+	dropped := testutil.ToFloat64(samplesDropped)
+	err := q.enqueue(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "a"}, Value: 1, Timestamp: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.drain(ctx); err == nil {
+		t.Errorf("Expected an error draining a queue stuck in a backoff")
+	}
+
+	// the writer gives up on the batch instead of sleeping through the backoff
+	deadline := time.Now().Add(10 * time.Second)
+	for q.queued() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if q.queued() != 0 {
+		t.Errorf("Invalid number of queued samples after aborting: %d, expected: 0", q.queued())
+	}
+	if v := testutil.ToFloat64(samplesDropped) - dropped; v != 1 {
+		t.Errorf("Invalid number of dropped samples: %v, expected: 1", v)
+	}
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	//_ "github.com/fajran/go-monetdb"
-	_ "github.internal.digitalocean.com/observability/monet/driver"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
@@ -21,7 +24,7 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-func initRead(db *sql.DB) {
+func initRead(mux *http.ServeMux, db *sql.DB) {
 	readHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -44,8 +47,32 @@ func initRead(db *sql.DB) {
 			return
 		}
 
+		s := currentSettings()
+
+		streamed, err := acceptsStreamedChunks(reqBuf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("HTTP Error %v on /read, cause: %s", http.StatusBadRequest, err)
+			return
+		}
+
+		// stream the response when the client supports it, so it never has to fit in memory
+		if streamed {
+			w.Header().Set("Content-Type", streamedReadResponseContentType)
+
+			cw := newChunkedWriter(w)
+			err = streamReadRequest(r.Context(), db, &req, cw, s.readTimeout)
+			if err != nil {
+				if !cw.written {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				log.Printf("HTTP Error %v on /read, cause: %s", http.StatusInternalServerError, err)
+			}
+			return
+		}
+
 		var resp *prompb.ReadResponse
-		resp, err = readRequest(db, &req)
+		resp, err = readRequest(r.Context(), db, &req, s.readParallelism, s.readTimeout)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			log.Printf("HTTP Error %v on /read, cause: %s", http.StatusInternalServerError, err)
@@ -78,184 +105,471 @@ func initRead(db *sql.DB) {
 		),
 	)
 
-	http.Handle("/read", readChain)
+	mux.Handle("/read", readChain)
 }
 
-func readRequest(db *sql.DB, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+// readRequest reads the results of the queries of a read request, giving up
+// once ctx is done or a query takes longer than timeout.
+func readRequest(ctx context.Context, db *sql.DB, req *prompb.ReadRequest, parallelism int, timeout time.Duration) (*prompb.ReadResponse, error) {
 	start := time.Now()
+
+	// the first error fails the request, so it cancels the queries still running
+	ctx, cancelRequest := context.WithCancel(ctx)
+	defer cancelRequest()
+
+	// run the queries concurrently, each one gets its own result in the order of the queries
+	results := make([]*prompb.QueryResult, len(req.Queries))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	for i, q := range req.Queries {
+		sem <- struct{}{}
+		// don't start more queries once the request failed or was canceled
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, q *prompb.Query) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			queryCtx, cancel := timeoutContext(ctx, timeout)
+			defer cancel()
+
+			timeseries, err := readQuery(queryCtx, db, q)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancelRequest()
+				})
+				return
+			}
+			results[i] = &prompb.QueryResult{Timeseries: timeseries}
+		}(i, q)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if ctx.Err() != nil {
+		return nil, errors.Wrap(ctx.Err(), "read request")
+	}
+
+	elapsed := time.Since(start)
+	log.Printf("read query took %s", elapsed)
+
+	return &prompb.ReadResponse{
+		Results: results,
+	}, nil
+}
+
+// timeoutContext returns a context that's done after timeout, or only when
+// parent is if timeout is 0
+func timeoutContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// readQuery reads the timeseries matching a single query of a read request
+func readQuery(ctx context.Context, db *sql.DB, q *prompb.Query) ([]*prompb.TimeSeries, error) {
 	promTimeseries := []*prompb.TimeSeries{}
 
-	for _, q := range req.Queries {
-		// figure out the metric name (and thus the table name)
-		name, err := getQueryMetricName(q)
+	// figure out the metric names (and thus the tables) the query touches
+	names, err := getQueryMetricNames(q)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		timeseries, err := readResolution(ctx, db, q, name)
 		if err != nil {
 			return nil, err
 		}
+		promTimeseries = append(promTimeseries, timeseries...)
+	}
 
-		// look up labels for metric name
-		labels, err := getLabels(db, name)
-		if err != nil {
-			return nil, err
+	return promTimeseries, nil
+}
+
+// metricSource is a table holding the samples of a metric
+type metricSource struct {
+	table string
+	// expression for the sample value
+	value string
+	// added to the timestamps of the rows
+	offset int64
+}
+
+// rawSource is the metric table with the raw samples of a metric
+func rawSource(name string) metricSource {
+	return metricSource{table: name, value: `"value"`}
+}
+
+// readRaw reads the timeseries matching a query from the raw samples of a metric
+func readRaw(ctx context.Context, db *sql.DB, q *prompb.Query, name string) ([]*prompb.TimeSeries, error) {
+	if storageLayout == layoutSeries {
+		return readSeriesMetric(ctx, db, q, name, rawSource(name))
+	}
+
+	// look up labels for metric name
+	labels, err := getLabels(db, name)
+	if err != nil {
+		return nil, err
+	}
+	return readMetric(ctx, db, q, name, labels, rawSource(name))
+}
+
+// readMetric reads the timeseries matching a query from a single metric table
+// with a column per label
+func readMetric(ctx context.Context, db *sql.DB, q *prompb.Query, name string, labels []string, src metricSource) ([]*prompb.TimeSeries, error) {
+	promTimeseries := []*prompb.TimeSeries{}
+
+	// bucket samples by timeseries label values
+	rawTimeseries := make(map[string][]*prompb.Sample)
+	err := scanMetric(ctx, db, q, labels, src, nil, func(labelValues []string, timestamp int64, value float64) error {
+		// TODO: Metric.Fingerprint() here? https://godoc.org/github.com/prometheus/common/model#Metric.Fingerprint
+		tsLabelKey := strings.Join(labelValues, labelKeySeparator)
+		rawTimeseries[tsLabelKey] = append(rawTimeseries[tsLabelKey], &prompb.Sample{
+			Timestamp: timestamp,
+			Value:     value,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// for each timeseries we found, make a Prometheus timeseries and attach the samples
+	for foundLabels, samples := range rawTimeseries {
+		promTimeseries = append(promTimeseries, &prompb.TimeSeries{
+			Labels:  metricLabels(name, labels, strings.Split(foundLabels, labelKeySeparator)),
+			Samples: samples,
+		})
+	}
+
+	return promTimeseries, nil
+}
+
+// scanMetric calls fn with the label values, timestamp and value of every row
+// of a metric table with a column per label that matches a query, oldest
+// first. If series is set, only the rows of the timeseries with those label
+// values are read, one timeseries after the other in the given order.
+func scanMetric(ctx context.Context, db *sql.DB, q *prompb.Query, labels []string, src metricSource, series [][]string, fn func([]string, int64, float64) error) error {
+	// build the query
+	query, args, filters, err := buildSelect(q, src, labels, series)
+	if err != nil {
+		return errors.Wrap(err, "build read query")
+	}
+
+	filterColumns := labelFilterColumns(filters, labels)
+
+	// execute the query
+	rows, err := db.QueryContext(ctx, query, args...)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "exec read metrics query")
+	}
+	defer rows.Close()
+
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+
+		// gymnastics to scan row into pointers
+		timestamp := new(int64)
+		value := new(float64)
+		rowScan := []interface{}{timestamp, value}
+		for _ = range labels {
+			rowScan = append(rowScan, new(sql.NullString))
 		}
 
-		// build the query
-		query, err := buildQuery(q, name, labels)
+		// read the row in
+		err := rows.Scan(rowScan...)
 		if err != nil {
-			return nil, errors.Wrap(err, "build read query")
+			rowScanErrors.Inc()
+			return errors.Wrap(err, "scan metric rows")
+		}
+
+		// get labels back out as strings, labels added after the row was written are NULL
+		rawLabels := rowScan[2:]
+		labelValues := make([]string, len(labels))
+		for i := range labelValues {
+			v, ok := rawLabels[i].(*sql.NullString)
+			if !ok {
+				return fmt.Errorf("could coerce interface for column value %+v to a string", v)
+			}
+			labelValues[i] = v.String
 		}
 
-		// execute the query
-		rows, err := db.Query(query)
-		dbQueries.Inc()
+		// drop rows that don't match the regexes we couldn't translate to SQL
+		if !matchesFilters(filters, filterColumns, labelValues) {
+			continue
+		}
+
+		err = fn(labelValues, *timestamp+src.offset, *value)
 		if err != nil {
-			queryErrors.Inc()
-			return nil, errors.Wrap(err, "exec read metrics query")
+			return err
 		}
-		defer rows.Close()
-
-		// process rows, bucketing samples by timeseries label values
-		rawTimeseries := make(map[string][]*prompb.Sample)
-		rowCount := 0
-		for rows.Next() {
-			rowCount++
-
-			// gymnastics to scan row into pointers
-			timestamp := new(int)
-			value := new(float64)
-			rowScan := []interface{}{timestamp, value}
-			for _ = range labels {
-				rowScan = append(rowScan, new(string))
-			}
+	}
 
-			// read the row in
-			err := rows.Scan(rowScan...)
-			if err != nil {
-				rowScanErrors.Inc()
-				return nil, errors.Wrap(err, "scan metric rows")
-			}
+	rowsRead.Add(float64(rowCount))
 
-			// get labels back out as strings
-			rawLabels := rowScan[2:]
-			labels := make([]string, len(labels))
-			for i := range labels {
-				v, ok := rawLabels[i].(*string)
-				if !ok {
-					return nil, fmt.Errorf("could coerce interface for column value %+v to a string", v)
-				}
-				labels[i] = *v
-			}
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return errors.Wrap(err, "read metric rows")
+	}
 
-			// TODO: Metric.Fingerprint() here? https://godoc.org/github.com/prometheus/common/model#Metric.Fingerprint
-			tsLabelKey := strings.Join(labels, ",")
+	return nil
+}
 
-			sample := &prompb.Sample{
-				Timestamp: int64(*timestamp),
-				Value:     *value,
-			}
+// metricLabels returns the labels of a timeseries from the values of the label
+// columns, leaving out empty ones as Prometheus treats those as missing
+func metricLabels(name string, labels []string, labelValues []string) []*prompb.Label {
+	// create a label for the __name__ label
+	labelPairs := []*prompb.Label{
+		&prompb.Label{
+			Name:  model.MetricNameLabel,
+			Value: name,
+		},
+	}
 
-			ts, exists := rawTimeseries[tsLabelKey]
-			if !exists {
-				rawTimeseries[tsLabelKey] = []*prompb.Sample{sample}
-				ts = rawTimeseries[tsLabelKey]
-			} else {
-				rawTimeseries[tsLabelKey] = append(ts, sample)
-			}
+	for i := range labels {
+		if labelValues[i] == "" {
+			continue
 		}
+		labelPairs = append(labelPairs, &prompb.Label{
+			Name:  labels[i],
+			Value: labelValues[i],
+		})
+	}
+	return labelPairs
+}
 
-		rowsRead.Add(float64(rowCount))
+// buildQuery builds the SQL query and its parameters for a remote read query,
+// along with any regex matchers that have to be applied to the rows it returns.
+func buildQuery(q *prompb.Query, src metricSource, labels []string) (string, []interface{}, []*labelFilter, error) {
+	return buildSelect(q, src, labels, nil)
+}
 
-		err = rows.Err()
-		if err != nil {
-			rowErrors.Inc()
-			return nil, errors.Wrap(err, "read metric rows")
-		}
+// buildSelect is buildQuery with the option of only selecting the timeseries
+// with the given label values, one after the other in the given order.
+func buildSelect(q *prompb.Query, src metricSource, labels []string, series [][]string) (string, []interface{}, []*labelFilter, error) {
+	where, args, filters, err := buildWhere(q, src, labels)
+	if err != nil {
+		return "", nil, nil, err
+	}
 
-		// for each timeseries we found, make a Prometheus timeseries and attach the samples
-		for foundLabels, samples := range rawTimeseries {
-			// create a label for the __name__ label
-			labelPairs := []*prompb.Label{
-				&prompb.Label{
-					Name:  model.MetricNameLabel,
-					Value: name,
-				},
-			}
+	labelColumns := make([]string, len(labels))
+	for i, label := range labels {
+		labelColumns[i] = monetdb.QuoteIdentifier(label)
+	}
 
-			// split the ordered label values and match them up with the foundLabels
-			splitLabelValues := strings.Split(foundLabels, ",")
-			for i := range labels {
-				labelPairs = append(labelPairs, &prompb.Label{
-					Name:  labels[i],
-					Value: splitLabelValues[i],
-				})
-			}
+	timestamp := `"timestamp"`
+	value := src.value
+	var clauses strings.Builder
+
+	// let MonetDB aggregate the samples of each step if that doesn't change the result
+	if aggregate, ok := pushdownAggregate(q.Hints); ok {
+		// the aggregate is stamped with the evaluation timestamp its step ends
+		// at, MAX only makes that an aggregate as it's the same for every row
+		bucket := pushdownBucket(q, src)
+		timestamp = fmt.Sprintf("MAX(%s)", bucket)
+		value = fmt.Sprintf("%s(%s)", aggregate, src.value)
+		groupBy := append([]string{bucket}, labelColumns...)
+		clauses.WriteString(" GROUP BY " + strings.Join(groupBy, ", "))
+	}
 
-			promTimeseries = append(promTimeseries, &prompb.TimeSeries{
-				Labels:  labelPairs,
-				Samples: samples,
-			})
+	// batches of a table are flushed concurrently and may commit in any order,
+	// so samples only come out oldest first if they're sorted
+	orderBy := []string{}
+	if len(series) > 0 && len(labels) > 0 {
+		// NULL and empty label values are the same timeseries
+		conds := make([]string, len(labelColumns))
+		for i, column := range labelColumns {
+			conds[i] = fmt.Sprintf("COALESCE(%s, '') = ?", column)
+		}
+		match := "(" + strings.Join(conds, " AND ") + ")"
+
+		matches := make([]string, len(series))
+		cases := make([]string, len(series))
+		orderArgs := []interface{}{}
+		for i, labelValues := range series {
+			matches[i] = match
+			cases[i] = fmt.Sprintf("WHEN %s THEN %d", match, i)
+			for _, v := range labelValues {
+				args = append(args, v)
+				orderArgs = append(orderArgs, v)
+			}
 		}
+		where += " AND (" + strings.Join(matches, " OR ") + ")"
+		orderBy = append(orderBy, "CASE "+strings.Join(cases, " ")+" END")
+		args = append(args, orderArgs...)
 	}
+	orderBy = append(orderBy, timestamp)
+	clauses.WriteString(" ORDER BY " + strings.Join(orderBy, ", "))
 
-	elapsed := time.Since(start)
-	log.Printf("read query took %s", elapsed)
-
-	return &prompb.ReadResponse{
-		Results: []*prompb.QueryResult{
-			{
-				Timeseries: promTimeseries,
-			},
-		},
-	}, nil
+	columns := append([]string{timestamp, value}, labelColumns...)
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s%s;", strings.Join(columns, ", "), monetdb.QuoteIdentifier(src.table), where, clauses.String()), args, filters, nil
 }
 
-func buildQuery(q *prompb.Query, name string, labels []string) (string, error) {
+// buildWhere builds the conditions of a query on a metric table with a
+// column per label, along with the regex matchers that have to be applied to
+// the rows it returns.
+func buildWhere(q *prompb.Query, src metricSource, labels []string) (string, []interface{}, []*labelFilter, error) {
 	matchers := make([]string, 0, len(q.Matchers))
+	args := []interface{}{}
+	filters := []*labelFilter{}
+
+	hasLabel := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		hasLabel[label] = true
+	}
 
 	for _, m := range q.Matchers {
 		if m.Name == model.MetricNameLabel || m.Name == "remote_read" {
 			continue
 		}
 
+		// a label the table doesn't have is empty for every row
+		if !hasLabel[m.Name] {
+			match, err := labelMatchFunc(m)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			if !match("") {
+				matchers = append(matchers, "1 = 0")
+			}
+			continue
+		}
+
+		// NULL means the series doesn't have the label, which is the same as an empty value
+		column := fmt.Sprintf("COALESCE(%s, '')", monetdb.QuoteIdentifier(m.Name))
 		switch m.Type {
 		case prompb.LabelMatcher_EQ:
-			matchers = append(matchers, fmt.Sprintf("%q = '%s'", m.Name, escapeSingleQuotes(m.Value)))
+			matchers = append(matchers, fmt.Sprintf("%s = ?", column))
+			args = append(args, m.Value)
 		case prompb.LabelMatcher_NEQ:
-			matchers = append(matchers, fmt.Sprintf("%q != '%s'", m.Name, escapeSingleQuotes(m.Value)))
-		case prompb.LabelMatcher_RE:
-			matchers = append(matchers, fmt.Sprintf("%q ILIKE '%s'", m.Name, replaceDotStar(m.Value)))
-		case prompb.LabelMatcher_NRE:
-			matchers = append(matchers, fmt.Sprintf("%q NOT ILIKE '%s'", m.Name, replaceDotStar(m.Value)))
+			matchers = append(matchers, fmt.Sprintf("%s != ?", column))
+			args = append(args, m.Value)
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			cond, condArgs, filter, err := regexCondition(column, m.Name, m.Value, m.Type == prompb.LabelMatcher_NRE)
+			if err != nil {
+				return "", nil, nil, errors.Wrapf(err, "invalid regex for label %s", m.Name)
+			}
+			if cond != "" {
+				matchers = append(matchers, cond)
+				args = append(args, condArgs...)
+			}
+			if filter != nil {
+				filters = append(filters, filter)
+			}
 		default:
-			return "", fmt.Errorf("unknown match type %v", m.Type)
+			return "", nil, nil, fmt.Errorf("unknown match type %v", m.Type)
 		}
 	}
-	matchers = append(matchers, fmt.Sprintf("timestamp >= %v", q.StartTimestampMs))
-	matchers = append(matchers, fmt.Sprintf("timestamp <= %v", q.EndTimestampMs))
+	matchers = append(matchers, `"timestamp" >= ?`, `"timestamp" <= ?`)
+	args = append(args, q.StartTimestampMs-src.offset, q.EndTimestampMs-src.offset)
 
-	// TODO: Group by timeseries value?
-	return fmt.Sprintf("SELECT timestamp, value, %s FROM %s WHERE %v;", strings.Join(labels, ", "), name, strings.Join(matchers, " AND ")), nil
+	return strings.Join(matchers, " AND "), args, filters, nil
 }
 
-func getQueryMetricName(q *prompb.Query) (string, error) {
+// labelKeySeparator can't appear in label values, which are valid UTF-8
+const labelKeySeparator = "\xff"
+
+// labelFilterColumns returns the index of the label column each filter
+// applies to, or -1 for labels the table doesn't have, which are empty
+func labelFilterColumns(filters []*labelFilter, labels []string) []int {
+	columns := make([]int, len(filters))
+	for i, f := range filters {
+		columns[i] = -1
+		for j, label := range labels {
+			if label == f.label {
+				columns[i] = j
+			}
+		}
+	}
+	return columns
+}
+
+func matchesFilters(filters []*labelFilter, filterColumns []int, labelValues []string) bool {
+	for i, f := range filters {
+		value := ""
+		if filterColumns[i] >= 0 {
+			value = labelValues[filterColumns[i]]
+		}
+		if !f.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// getQueryMetricNames resolves the __name__ matchers of a query against the
+// known metric tables.
+func getQueryMetricNames(q *prompb.Query) ([]string, error) {
+	nameMatchers := []*prompb.LabelMatcher{}
 	for _, m := range q.Matchers {
 		if m.Name == model.MetricNameLabel {
-			switch m.Type {
-			case prompb.LabelMatcher_EQ:
-				return m.Value, nil
-			default:
-				// TODO: Figure out how to support these.
-				return "", fmt.Errorf("non-equal or regex/regex-non-equal matchers are not supported on the metric name yet")
+			nameMatchers = append(nameMatchers, m)
+		}
+	}
+	if len(nameMatchers) == 0 {
+		return nil, fmt.Errorf("could not find metric name in query")
+	}
+
+	matches := make([]func(string) bool, len(nameMatchers))
+	for i, m := range nameMatchers {
+		match, err := labelMatchFunc(m)
+		if err != nil {
+			return nil, err
+		}
+		matches[i] = match
+	}
+
+	names := []string{}
+	for name := range currentLabelsMap() {
+		matched := true
+		for _, match := range matches {
+			if !match(name) {
+				matched = false
+				break
 			}
-			continue
+		}
+		if matched {
+			names = append(names, name)
 		}
 	}
-	return "", fmt.Errorf("could not find metric name in query")
-}
+	sort.Strings(names)
 
-func escapeSingleQuotes(str string) string {
-	return strings.Replace(str, `'`, `\'`, -1)
+	return names, nil
 }
 
-func replaceDotStar(str string) string {
-	return strings.Replace(str, `.*`, `%`, -1)
+// labelMatchFunc returns a function that evaluates a matcher against a label value
+func labelMatchFunc(m *prompb.LabelMatcher) (func(string) bool, error) {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return func(v string) bool { return v == m.Value }, nil
+	case prompb.LabelMatcher_NEQ:
+		return func(v string) bool { return v != m.Value }, nil
+	case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+		re, err := compileAnchored(m.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regex for label %s", m.Name)
+		}
+		negate := m.Type == prompb.LabelMatcher_NRE
+		return func(v string) bool { return re.MatchString(v) != negate }, nil
+	default:
+		return nil, fmt.Errorf("unknown match type %v", m.Type)
+	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestGetQueryMetricNames(t *testing.T) {
+	labelsMap.Store(map[string]string{
+		"node_cpu":         "cpu,mode",
+		"node_load1":       "",
+		"up":               "instance,job",
+		"prometheus_build": "version",
+	})
+	defer func() { labelsMap.Store(map[string]string{}) }()
+
+	tcs := []struct {
+		matchers []*prompb.LabelMatcher
+		names    []string
+	}{
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "up"}},
+			[]string{"up"},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "missing"}},
+			[]string{},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: model.MetricNameLabel, Value: "up"}},
+			[]string{"node_cpu", "node_load1", "prometheus_build"},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: model.MetricNameLabel, Value: "node_.*"}},
+			[]string{"node_cpu", "node_load1"},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: model.MetricNameLabel, Value: "node"}},
+			[]string{},
+		},
+		{
+			[]*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_NRE, Name: model.MetricNameLabel, Value: "node_.*"},
+				{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"},
+			},
+			[]string{"prometheus_build", "up"},
+		},
+		{
+			[]*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_RE, Name: model.MetricNameLabel, Value: "node_.*"},
+				{Type: prompb.LabelMatcher_NEQ, Name: model.MetricNameLabel, Value: "node_cpu"},
+			},
+			[]string{"node_load1"},
+		},
+	}
+
+	for _, tc := range tcs {
+		names, err := getQueryMetricNames(&prompb.Query{Matchers: tc.matchers})
+		if err != nil {
+			t.Errorf("Error resolving %v: %v", tc.matchers, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("Invalid names for %v: %v, expected: %v", tc.matchers, names, tc.names)
+		}
+	}
+
+	_, err := getQueryMetricNames(&prompb.Query{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "node"}}})
+	if err == nil {
+		t.Errorf("Expected an error for a query without a metric name")
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	q := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "remote_read", Value: "true"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "it's"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "instance", Value: "a"},
+			{Type: prompb.LabelMatcher_RE, Name: "env", Value: "prod|staging"},
+			{Type: prompb.LabelMatcher_NRE, Name: "region", Value: "(?i)eu.*"},
+		},
+	}
+
+	query, args, filters, err := buildQuery(q, rawSource("up"), []string{"env", "instance", "job", "region"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := `SELECT "timestamp", "value", "env", "instance", "job", "region" FROM "up" WHERE COALESCE("job", '') = ? AND COALESCE("instance", '') != ? AND COALESCE("env", '') IN (?, ?) AND "timestamp" >= ? AND "timestamp" <= ? ORDER BY "timestamp";`
+	if query != e {
+		t.Errorf("Invalid query: %s, expected: %s", query, e)
+	}
+
+	eArgs := []interface{}{"it's", "a", "prod", "staging", int64(1000), int64(2000)}
+	if !reflect.DeepEqual(args, eArgs) {
+		t.Errorf("Invalid args: %v, expected: %v", args, eArgs)
+	}
+
+	if len(filters) != 1 || filters[0].label != "region" || !filters[0].negate {
+		t.Errorf("Invalid filters: %v", filters)
+	}
+}
+
+func TestBuildQueryMissingLabel(t *testing.T) {
+	tcs := []struct {
+		matcher *prompb.LabelMatcher
+		cond    string
+	}{
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "missing", Value: ""}, ""},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "missing", Value: "a"}, "1 = 0 AND "},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "missing", Value: "a"}, ""},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "missing", Value: "a|"}, ""},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "missing", Value: ".*"}, "1 = 0 AND "},
+	}
+
+	for _, tc := range tcs {
+		q := &prompb.Query{Matchers: []*prompb.LabelMatcher{tc.matcher}}
+		query, _, _, err := buildQuery(q, rawSource("up"), []string{"job"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := `SELECT "timestamp", "value", "job" FROM "up" WHERE ` + tc.cond + `"timestamp" >= ? AND "timestamp" <= ? ORDER BY "timestamp";`
+		if query != e {
+			t.Errorf("Invalid query for %v: %s, expected: %s", tc.matcher, query, e)
+		}
+	}
+}
+
+func TestBuildSelectSeries(t *testing.T) {
+	q := &prompb.Query{StartTimestampMs: 1000, EndTimestampMs: 2000}
+
+	query, args, _, err := buildSelect(q, rawSource("up"), []string{"instance", "job"}, [][]string{{"b", "api"}, {"a", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := `(COALESCE("instance", '') = ? AND COALESCE("job", '') = ?)`
+	e := `SELECT "timestamp", "value", "instance", "job" FROM "up" WHERE "timestamp" >= ? AND "timestamp" <= ? AND (` + match + ` OR ` + match + `) ORDER BY CASE WHEN ` + match + ` THEN 0 WHEN ` + match + ` THEN 1 END, "timestamp";`
+	if query != e {
+		t.Errorf("Invalid query: %s, expected: %s", query, e)
+	}
+
+	eArgs := []interface{}{int64(1000), int64(2000), "b", "api", "a", "", "b", "api", "a", ""}
+	if !reflect.DeepEqual(args, eArgs) {
+		t.Errorf("Invalid args: %v, expected: %v", args, eArgs)
+	}
+}
+
+func TestBuildQueryPushdown(t *testing.T) {
+	pushdownEnabled = true
+	defer func() { pushdownEnabled = false }()
+
+	q := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+		},
+		Hints: &prompb.ReadHints{StepMs: 100, Func: "max_over_time"},
+	}
+
+	query, args, _, err := buildQuery(q, rawSource("up"), []string{"job"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows in (1000, 1100] are stamped 1100, rows in (1100, 1200] 1200 and so on
+	bucket := `1000 + ("timestamp" - 1000 + 99) / 100 * 100`
+	e := `SELECT MAX(` + bucket + `), MAX("value"), "job" FROM "up" WHERE COALESCE("job", '') = ? AND "timestamp" >= ? AND "timestamp" <= ? GROUP BY ` + bucket + `, "job" ORDER BY MAX(` + bucket + `);`
+	if query != e {
+		t.Errorf("Invalid query: %s, expected: %s", query, e)
+	}
+
+	eArgs := []interface{}{"api", int64(1000), int64(2000)}
+	if !reflect.DeepEqual(args, eArgs) {
+		t.Errorf("Invalid args: %v, expected: %v", args, eArgs)
+	}
+
+	// functions that need every sample get raw samples
+	for _, hints := range []*prompb.ReadHints{
+		{StepMs: 100, Func: "rate"},
+		{StepMs: 100, Func: "avg_over_time"},
+		{StepMs: 100, Func: "count_over_time"},
+		{StepMs: 100},
+		{Func: "max_over_time"},
+		nil,
+	} {
+		q.Hints = hints
+		query, _, _, err := buildQuery(q, rawSource("up"), []string{"job"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(query, "GROUP BY") {
+			t.Errorf("Aggregation pushed down for %+v: %s", hints, query)
+		}
+	}
+}
+
+func TestReadRequestResults(t *testing.T) {
+	labelsMap.Store(map[string]string{})
+
+	// queries for metrics without tables don't touch the database
+	req := &prompb.ReadRequest{}
+	for i := 0; i < 5; i++ {
+		req.Queries = append(req.Queries, &prompb.Query{
+			StartTimestampMs: int64(i),
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "missing"}},
+		})
+	}
+
+	resp, err := readRequest(context.Background(), nil, req, 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != len(req.Queries) {
+		t.Fatalf("Invalid number of results: %d, expected: %d", len(resp.Results), len(req.Queries))
+	}
+	for i, result := range resp.Results {
+		if result == nil || len(result.Timeseries) != 0 {
+			t.Errorf("Invalid result %d: %v", i, result)
+		}
+	}
+
+	req.Queries[3].Matchers = []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}}
+	if _, err := readRequest(context.Background(), nil, req, 2, time.Second); err == nil {
+		t.Errorf("Expected an error for a query without a metric name")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := readRequest(ctx, nil, req, 2, time.Second); err == nil {
+		t.Errorf("Expected an error for a canceled request")
+	}
+}
+
+func TestReadRequestStopsAfterError(t *testing.T) {
+	labelsMap.Store(map[string]string{"up": ""})
+
+	// the first query fails, the ones after it would read the table through a nil db
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{
+		{Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}}},
+	}}
+	for i := 0; i < 3; i++ {
+		req.Queries = append(req.Queries, &prompb.Query{
+			Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "up"}},
+		})
+	}
+
+	if _, err := readRequest(context.Background(), nil, req, 1, time.Second); err == nil {
+		t.Errorf("Expected an error for a query without a metric name")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// relabel actions, the same as those of Prometheus' metric_relabel_configs
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelHashMod   = "hashmod"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+)
+
+// relabelConfig is a relabel rule as written in the config file
+type relabelConfig struct {
+	// identifies the rule in metrics, defaults to its position
+	Name         string   `yaml:"name,omitempty"`
+	SourceLabels []string `yaml:"sourceLabels,flow,omitempty"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"targetLabel,omitempty"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+// UnmarshalYAML fills in the defaults Prometheus uses for missing fields
+func (c *relabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = relabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      relabelReplace,
+	}
+	type plain relabelConfig
+	return unmarshal((*plain)(c))
+}
+
+// relabelRule is a compiled relabel rule
+type relabelRule struct {
+	relabelConfig
+	regex *regexp.Regexp
+
+	kept    prometheus.Counter
+	dropped prometheus.Counter
+}
+
+// compileRelabelRules checks and compiles relabel rules, in order
+func compileRelabelRules(configs []relabelConfig) ([]*relabelRule, error) {
+	rules := make([]*relabelRule, 0, len(configs))
+	for i, c := range configs {
+		name := c.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+
+		regex, err := compileAnchored(c.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex of relabel rule %s: %s", name, err)
+		}
+
+		switch c.Action {
+		case relabelReplace:
+			if c.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %s needs a targetLabel", name)
+			}
+		case relabelHashMod:
+			if c.TargetLabel == "" || c.Modulus == 0 {
+				return nil, fmt.Errorf("relabel rule %s needs a targetLabel and a positive modulus", name)
+			}
+		case relabelKeep, relabelDrop, relabelLabelDrop, relabelLabelKeep:
+		default:
+			return nil, fmt.Errorf("unknown action %q of relabel rule %s", c.Action, name)
+		}
+
+		rules = append(rules, &relabelRule{
+			relabelConfig: c,
+			regex:         regex,
+			kept:          relabelSeries.WithLabelValues(name, "kept"),
+			dropped:       relabelSeries.WithLabelValues(name, "dropped"),
+		})
+	}
+	return rules, nil
+}
+
+// relabel applies rules to the labels of a series in order, returning the new
+// labels or nil if a rule dropped the series. The given labels aren't changed.
+func relabel(labels []*prompb.Label, rules []*relabelRule) []*prompb.Label {
+	if len(rules) == 0 {
+		return labels
+	}
+
+	lset := make(map[string]string, len(labels))
+	for _, l := range labels {
+		lset[l.Name] = l.Value
+	}
+
+	for _, rule := range rules {
+		if !rule.apply(lset) {
+			rule.dropped.Inc()
+			return nil
+		}
+		rule.kept.Inc()
+	}
+
+	relabeled := make([]*prompb.Label, 0, len(lset))
+	for name, value := range lset {
+		// an empty value is the same as a missing label
+		if value == "" {
+			continue
+		}
+		relabeled = append(relabeled, &prompb.Label{Name: name, Value: value})
+	}
+	return relabeled
+}
+
+// apply changes the label set of a series, returning false if the series is dropped
+func (r *relabelRule) apply(lset map[string]string) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = lset[name]
+	}
+	value := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case relabelKeep:
+		return r.regex.MatchString(value)
+	case relabelDrop:
+		return !r.regex.MatchString(value)
+	case relabelReplace:
+		indexes := r.regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.TargetLabel, value, indexes))
+		if !model.LabelName(target).IsValid() {
+			return true
+		}
+		lset[target] = string(r.regex.ExpandString(nil, r.Replacement, value, indexes))
+	case relabelHashMod:
+		lset[r.TargetLabel] = strconv.FormatUint(hashSum64(value)%r.Modulus, 10)
+	case relabelLabelDrop:
+		for name := range lset {
+			if r.regex.MatchString(name) {
+				delete(lset, name)
+			}
+		}
+	case relabelLabelKeep:
+		for name := range lset {
+			if !r.regex.MatchString(name) {
+				delete(lset, name)
+			}
+		}
+	}
+	return true
+}
+
+// hashSum64 hashes a value the way Prometheus does for hashmod, so series get
+// sharded the same way
+func hashSum64(value string) uint64 {
+	hash := md5.Sum([]byte(value))
+	var s uint64
+	for _, b := range hash[md5.Size-8:] {
+		s = s<<8 | uint64(b)
+	}
+	return s
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+func parseRelabelRules(t *testing.T, config string) []*relabelRule {
+	configs := []relabelConfig{}
+	err := yaml.UnmarshalStrict([]byte(config), &configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := compileRelabelRules(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func labelMap(labels []*prompb.Label) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	m := map[string]string{}
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+func TestRelabel(t *testing.T) {
+	input := []*prompb.Label{
+		{Name: "__name__", Value: "node_cpu"},
+		{Name: "instance", Value: "host-1:9100"},
+		{Name: "job", Value: "node"},
+		{Name: "mode", Value: "idle"},
+	}
+
+	tcs := []struct {
+		name   string
+		config string
+		output map[string]string
+	}{
+		{
+			"keep matching",
+			"- {action: keep, sourceLabels: [__name__], regex: node_.*}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "job": "node", "mode": "idle"},
+		},
+		{
+			"keep not matching",
+			"- {action: keep, sourceLabels: [__name__], regex: node}",
+			nil,
+		},
+		{
+			"drop with separator",
+			"- {action: drop, sourceLabels: [job, mode], separator: '/', regex: node/idle}",
+			nil,
+		},
+		{
+			"drop missing label",
+			"- {action: drop, sourceLabels: [missing], regex: .+}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "job": "node", "mode": "idle"},
+		},
+		{
+			// like Prometheus, the regex is matched against the empty value of no source labels
+			"keep without source labels",
+			"- {action: keep}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "job": "node", "mode": "idle"},
+		},
+		{
+			"drop without source labels",
+			"- {action: drop, regex: ''}",
+			nil,
+		},
+		{
+			"replace with defaults",
+			"- {sourceLabels: [instance], regex: '(.*):\\d+', targetLabel: host}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "host": "host-1", "job": "node", "mode": "idle"},
+		},
+		{
+			"replace not matching",
+			"- {sourceLabels: [job], regex: prometheus, targetLabel: job, replacement: prom}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "job": "node", "mode": "idle"},
+		},
+		{
+			"replace with empty value removes label",
+			"- {sourceLabels: [mode], regex: idle, targetLabel: mode, replacement: ''}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "job": "node"},
+		},
+		{
+			"labeldrop",
+			"- {action: labeldrop, regex: instance|mode}",
+			map[string]string{"__name__": "node_cpu", "job": "node"},
+		},
+		{
+			"labelkeep",
+			"- {action: labelkeep, regex: __name__|job}",
+			map[string]string{"__name__": "node_cpu", "job": "node"},
+		},
+		{
+			"rules apply in order",
+			"- {action: labeldrop, regex: mode}\n- {action: drop, sourceLabels: [mode], regex: idle}",
+			map[string]string{"__name__": "node_cpu", "instance": "host-1:9100", "job": "node"},
+		},
+	}
+
+	for _, tc := range tcs {
+		output := relabel(input, parseRelabelRules(t, tc.config))
+		if !reflect.DeepEqual(labelMap(output), tc.output) {
+			t.Errorf("Invalid labels for %s: %v, expected: %v", tc.name, labelMap(output), tc.output)
+		}
+	}
+
+	// the input isn't changed
+	if len(input) != 4 || input[3].Value != "idle" {
+		t.Errorf("Input labels changed: %v", input)
+	}
+}
+
+func TestRelabelHashMod(t *testing.T) {
+	rules := parseRelabelRules(t, "- {action: hashmod, sourceLabels: [instance], modulus: 4, targetLabel: shard}\n- {action: keep, sourceLabels: [shard], regex: '1'}")
+
+	shards := map[string]int{}
+	for _, instance := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		labels := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: instance}}
+		output := relabel(labels, rules[:1])
+		shard := labelMap(output)["shard"]
+		shards[shard]++
+
+		// the same value always lands in the same shard
+		if again := labelMap(relabel(labels, rules[:1]))["shard"]; again != shard {
+			t.Errorf("Different shards for %s: %s and %s", instance, shard, again)
+		}
+
+		kept := relabel(labels, rules) != nil
+		if kept != (shard == "1") {
+			t.Errorf("Series in shard %s kept: %v", shard, kept)
+		}
+	}
+
+	for shard := range shards {
+		if shard != "0" && shard != "1" && shard != "2" && shard != "3" {
+			t.Errorf("Invalid shard: %s", shard)
+		}
+	}
+}
+
+func TestRelabelCounters(t *testing.T) {
+	rules := parseRelabelRules(t, "- {name: only_up, action: keep, sourceLabels: [__name__], regex: up}")
+	kept := testutil.ToFloat64(rules[0].kept)
+	dropped := testutil.ToFloat64(rules[0].dropped)
+
+	relabel([]*prompb.Label{{Name: "__name__", Value: "up"}}, rules)
+	relabel([]*prompb.Label{{Name: "__name__", Value: "down"}}, rules)
+	relabel([]*prompb.Label{{Name: "__name__", Value: "down"}}, rules)
+
+	if v := testutil.ToFloat64(relabelSeries.WithLabelValues("only_up", "kept")); v != kept+1 {
+		t.Errorf("Invalid kept count: %v, expected: %v", v, kept+1)
+	}
+	if v := testutil.ToFloat64(relabelSeries.WithLabelValues("only_up", "dropped")); v != dropped+2 {
+		t.Errorf("Invalid dropped count: %v, expected: %v", v, dropped+2)
+	}
+}
+
+func TestCompileRelabelRulesInvalid(t *testing.T) {
+	for _, config := range []string{
+		"- {action: replace, sourceLabels: [a]}",
+		"- {action: hashmod, sourceLabels: [a], targetLabel: b}",
+		"- {action: labeldrop, regex: '('}",
+		"- {action: relabel, sourceLabels: [a]}",
+	} {
+		configs := []relabelConfig{}
+		err := yaml.UnmarshalStrict([]byte(config), &configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := compileRelabelRules(configs); err == nil {
+			t.Errorf("Expected an error for %s", config)
+		}
+	}
+}
+
+func TestProtoToSamplesFiltering(t *testing.T) {
+	defer settings.Store(currentSettings())
+
+	c := defaultConfig()
+	c.Whitelist = []string{"up", "node_.*"}
+	c.RelabelConfigs = []relabelConfig{{
+		SourceLabels: []string{"mode"},
+		Separator:    ";",
+		Regex:        "iowait",
+		Action:       relabelDrop,
+	}}
+	s, err := newRuntimeSettings(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Store(s)
+	labelsMap.Store(map[string]string{})
+
+	req := &prompb.WriteRequest{}
+	for _, labels := range [][]*prompb.Label{
+		{{Name: "__name__", Value: "up"}},
+		{{Name: "__name__", Value: "node_cpu"}, {Name: "mode", Value: "idle"}},
+		{{Name: "__name__", Value: "node_cpu"}, {Name: "mode", Value: "iowait"}},
+		{{Name: "__name__", Value: "go_goroutines"}},
+		{{Name: "__name__", Value: "xnode_cpu"}},
+	} {
+		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []*prompb.Sample{{Timestamp: 1, Value: 1}},
+		})
+	}
+
+	samples := protoToSamples(req)
+	names := []string{}
+	for _, sample := range samples {
+		names = append(names, sample.Metric.String())
+	}
+	e := []string{"up", `node_cpu{mode="idle"}`}
+	if !reflect.DeepEqual(names, e) {
+		t.Errorf("Invalid samples: %v, expected: %v", names, e)
+	}
+}
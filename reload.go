@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runtimeSettings are the parts of the config that can change without a
+// restart. They're swapped as a whole on reload, so readers always see the
+// settings of a single config.
+type runtimeSettings struct {
+	whitelist    *metricWhitelist
+	relabelRules []*relabelRule
+
+	// authenticators by endpoint group
+	auth map[string]*authenticator
+
+	readParallelism int
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+
+	retention *retentionPolicy
+
+	shutdownTimeout time.Duration
+}
+
+var settings atomic.Value
+
+func init() {
+	s, err := newRuntimeSettings(defaultConfig())
+	if err != nil {
+		panic(err)
+	}
+	settings.Store(s)
+}
+
+// currentSettings returns the runtime settings of the last loaded config
+func currentSettings() *runtimeSettings {
+	return settings.Load().(*runtimeSettings)
+}
+
+func newRuntimeSettings(c *config) (*runtimeSettings, error) {
+	whitelist, err := newMetricWhitelist(c.Whitelist)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := compileRelabelRules(c.RelabelConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	apiAuth, err := newAuthenticator(c.Auth.API)
+	if err != nil {
+		return nil, errors.Wrap(err, "api auth")
+	}
+	metricsAuth, err := newAuthenticator(c.Auth.Metrics)
+	if err != nil {
+		return nil, errors.Wrap(err, "metrics auth")
+	}
+
+	return &runtimeSettings{
+		whitelist:       whitelist,
+		relabelRules:    rules,
+		auth:            map[string]*authenticator{authAPI: apiAuth, authMetrics: metricsAuth},
+		readParallelism: c.Read.Parallelism,
+		readTimeout:     c.Read.Timeout,
+		writeTimeout:    c.Write.Timeout,
+		retention: &retentionPolicy{
+			retention: c.Retention.Retention,
+			overrides: c.Retention.Overrides,
+			dryRun:    c.Retention.DryRun,
+		},
+		shutdownTimeout: c.ShutdownTimeout,
+	}, nil
+}
+
+// applyConfig makes the runtime settings of c current
+func applyConfig(db *sql.DB, c *config) error {
+	s, err := newRuntimeSettings(c)
+	if err != nil {
+		return err
+	}
+
+	db.SetConnMaxLifetime(c.DB.ConnMaxLifetime)
+	db.SetMaxOpenConns(c.DB.MaxOpenConns)
+	db.SetMaxIdleConns(c.DB.MaxIdleConns)
+
+	settings.Store(s)
+	return nil
+}
+
+// restartSettings returns the names of the settings that differ between two
+// configs but are only picked up on restart
+func restartSettings(old *config, new *config) []string {
+	changed := []string{}
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+
+	check("db.url", old.DB.URL, new.DB.URL)
+	check("db.storageLayout", old.DB.StorageLayout, new.DB.StorageLayout)
+	check("db.partitionInterval", old.DB.PartitionInterval, new.DB.PartitionInterval)
+	check("listen", old.Listen, new.Listen)
+	check("write.batchSize", old.Write.BatchSize, new.Write.BatchSize)
+	check("write.flushInterval", old.Write.FlushInterval, new.Write.FlushInterval)
+	check("write.queueSize", old.Write.QueueSize, new.Write.QueueSize)
+	check("write.workers", old.Write.Workers, new.Write.Workers)
+	check("read.pushdown", old.Read.Pushdown, new.Read.Pushdown)
+	check("retention.interval", old.Retention.Interval, new.Retention.Interval)
+	check("rollups", old.Rollups, new.Rollups)
+	return changed
+}
+
+// reloader loads the config again from the same arguments, config file and
+// environment it was first loaded from.
+type reloader struct {
+	db     *sql.DB
+	name   string
+	args   []string
+	getenv func(string) string
+
+	mtx     sync.Mutex
+	current *config
+}
+
+func newReloader(db *sql.DB, current *config, name string, args []string, getenv func(string) string) *reloader {
+	return &reloader{
+		db:      db,
+		name:    name,
+		args:    args,
+		getenv:  getenv,
+		current: current,
+	}
+}
+
+// reload loads and applies the config, keeping the current one if the new
+// one is invalid
+func (r *reloader) reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	c, err := loadConfig(r.name, r.args, r.getenv)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	for _, name := range restartSettings(r.current, c) {
+		log.Printf("config reload: %s changed, the new value is used after a restart", name)
+	}
+
+	err = applyConfig(r.db, c)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	r.current = c
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	log.Printf("reloaded config")
+	return nil
+}
+
+// startReloader reloads the config on SIGHUP and POST /-/reload
+func startReloader(bg *background, r *reloader, mux *http.ServeMux) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	bg.run(func(ctx context.Context) {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				err := r.reload()
+				if err != nil {
+					log.Printf("error reloading config: %s", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	mux.Handle("/-/reload", r)
+}
+
+// ServeHTTP reloads the config on POST requests
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		log.Printf("HTTP Error %v on /-/reload, cause: %s", http.StatusInternalServerError, err)
+		return
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReload(t *testing.T) {
+	path := writeConfigFile(t, "whitelist: [up]\nread:\n  timeout: 10s\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	defer settings.Store(currentSettings())
+
+	db, err := sql.Open("monetdb", "localhost/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	args := []string{"-config", path}
+	getenv := func(string) string { return "" }
+	c, err := loadConfig("adapter", args, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyConfig(db, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReloader(db, c, "adapter", args, getenv)
+
+	if !reflect.DeepEqual(currentSettings().whitelist.names, map[string]bool{"up": true}) {
+		t.Errorf("Invalid whitelist: %v", currentSettings().whitelist.names)
+	}
+
+	err = ioutil.WriteFile(path, []byte("whitelist: [up, node_load1]\nread:\n  timeout: 20s\nretention:\n  retention: 24h\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status: %d, body: %s", w.Code, w.Body.String())
+	}
+
+	s := currentSettings()
+	if !reflect.DeepEqual(s.whitelist.names, map[string]bool{"up": true, "node_load1": true}) {
+		t.Errorf("Invalid whitelist after reload: %v", s.whitelist.names)
+	}
+	if s.readTimeout != 20*time.Second || s.retention.retention != 24*time.Hour {
+		t.Errorf("Invalid settings after reload: %+v", s)
+	}
+	if v := testutil.ToFloat64(configReloadSuccess); v != 1 {
+		t.Errorf("Invalid reload success: %v", v)
+	}
+
+	// an invalid config keeps the current settings
+	err = ioutil.WriteFile(path, []byte("write:\n  batchSize: -1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Invalid status for an invalid config: %d", w.Code)
+	}
+	if currentSettings() != s {
+		t.Errorf("Settings changed by an invalid config")
+	}
+	if v := testutil.ToFloat64(configReloadSuccess); v != 0 {
+		t.Errorf("Invalid reload success: %v", v)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Invalid status for GET: %d", w.Code)
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	old := defaultConfig()
+	new := defaultConfig()
+	new.Whitelist = []string{"up"}
+	new.Read.Timeout = time.Second
+	new.Listen.Address = ":9201"
+	new.Write.Workers = 8
+
+	changed := restartSettings(old, new)
+	e := []string{"listen", "write.workers"}
+	if !reflect.DeepEqual(changed, e) {
+		t.Errorf("Invalid restart settings: %v, expected: %v", changed, e)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	//_ "github.com/fajran/go-monetdb"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
+
+	"github.com/pkg/errors"
+)
+
+var deleteOldSamplesQuery string = `
+DELETE FROM %s WHERE "timestamp" < ?;`
+
+var countOldSamplesQuery string = `
+SELECT COUNT(*) FROM %s WHERE "timestamp" < ?;`
+
+// retentionPolicy decides how long samples are kept for each metric. A
+// retention of 0 keeps samples forever.
+type retentionPolicy struct {
+	retention time.Duration
+	overrides map[string]time.Duration
+	dryRun    bool
+}
+
+// parseRetentionOverrides parses a comma-separated list of metric=duration pairs
+func parseRetentionOverrides(str string) (map[string]time.Duration, error) {
+	overrides := map[string]time.Duration{}
+	if str == "" {
+		return overrides, nil
+	}
+
+	for _, override := range strings.Split(str, ",") {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid retention override %q, expected metric=duration", override)
+		}
+
+		retention, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid retention for metric %s", parts[0])
+		}
+		if retention < 0 {
+			return nil, fmt.Errorf("invalid retention for metric %s: must not be negative", parts[0])
+		}
+		overrides[parts[0]] = retention
+	}
+	return overrides, nil
+}
+
+// metricRetention returns how long samples of a metric are kept
+func (p *retentionPolicy) metricRetention(name string) time.Duration {
+	if retention, ok := p.overrides[name]; ok {
+		return retention
+	}
+	return p.retention
+}
+
+// enabled is true if samples of any metric ever get deleted
+func (p *retentionPolicy) enabled() bool {
+	if p.retention > 0 {
+		return true
+	}
+	for _, retention := range p.overrides {
+		if retention > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// startRetention deletes old samples every interval until the background is
+// stopped, following the retention policy of the current settings
+func startRetention(bg *background, db *sql.DB, interval time.Duration) {
+	bg.every(interval, func(now time.Time) {
+		policy := currentSettings().retention
+		if !policy.enabled() {
+			return
+		}
+
+		err := runRetention(db, policy, now)
+		if err != nil {
+			log.Printf("retention run failed: %s", err)
+		}
+	})
+}
+
+// runRetention deletes samples older than their metric's retention from every
+// metric table, or only counts them in dry-run mode. A failing table doesn't
+// stop the others from being cleaned up.
+func runRetention(db *sql.DB, policy *retentionPolicy, now time.Time) error {
+	start := time.Now()
+	defer func() {
+		retentionRunDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	tables := currentLabelsMap()
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// rollup tables aren't in the meta table
+	existing, err := listTables(db)
+	if err != nil {
+		return errors.Wrap(err, "list tables")
+	}
+	tableSet := make(map[string]bool, len(existing))
+	for _, table := range existing {
+		tableSet[table] = true
+	}
+
+	failed := []string{}
+	for _, name := range names {
+		retention := policy.metricRetention(name)
+		if retention <= 0 {
+			continue
+		}
+
+		// partitioned tables drop whole partitions, so samples are kept until
+		// every sample of their partition is past the retention
+		deleteFn := deleteOldSamples
+		if partitionInterval > 0 {
+			deleteFn = dropOldPartitions
+		}
+
+		cutoff := retentionCutoff(now, retention)
+		deleted, err := deleteFn(db, name, cutoff, policy.dryRun)
+		if err != nil {
+			log.Printf("error applying retention to table %s: %s", name, err)
+			failed = append(failed, name)
+			continue
+		}
+
+		// rollups are kept as long as the samples they aggregate, they're never partitioned
+		rollupsFailed := false
+		for _, table := range metricRollupTables(name, tableSet) {
+			rolledUp, err := deleteOldSamples(db, table, cutoff, policy.dryRun)
+			if err != nil {
+				log.Printf("error applying retention to table %s: %s", table, err)
+				failed = append(failed, table)
+				rollupsFailed = true
+				continue
+			}
+			deleted += rolledUp
+		}
+		if rollupsFailed {
+			continue
+		}
+
+		// series without samples left are dropped from the series table
+		if storageLayout == layoutSeries {
+			pruned, err := pruneSeries(db, name, policy.dryRun)
+			if err != nil {
+				log.Printf("error pruning series of table %s: %s", name, err)
+				failed = append(failed, name)
+				continue
+			}
+			if pruned > 0 {
+				log.Printf("retention pruned %d series without samples of table %s", pruned, name)
+			}
+		}
+
+		if deleted == 0 {
+			continue
+		}
+
+		if policy.dryRun {
+			log.Printf("retention dry run: would delete %d rows older than %s from table %s and its rollups", deleted, retention, name)
+		} else {
+			retentionRowsDeleted.Add(float64(deleted))
+			log.Printf("retention deleted %d rows older than %s from table %s and its rollups", deleted, retention, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not apply retention to tables %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// metricRollupTables returns the rollup tables of a metric among the existing tables
+func metricRollupTables(name string, existing map[string]bool) []string {
+	tables := []string{}
+	for _, res := range rollupResolutions {
+		if table := rollupTableName(name, res); existing[table] {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// retentionCutoff returns the timestamp in milliseconds before which samples are deleted
+func retentionCutoff(now time.Time, retention time.Duration) int64 {
+	return now.Add(-retention).UnixNano() / int64(time.Millisecond)
+}
+
+// deleteOldSamples deletes the rows of a metric table older than the cutoff and
+// returns how many there were, only counting them when dryRun is set.
+func deleteOldSamples(db *sql.DB, name string, cutoff int64, dryRun bool) (int64, error) {
+	if dryRun {
+		var count int64
+		err := db.QueryRow(fmt.Sprintf(countOldSamplesQuery, monetdb.QuoteIdentifier(name)), cutoff).Scan(&count)
+		dbQueries.Inc()
+		if err != nil {
+			queryErrors.Inc()
+			return 0, errors.Wrap(err, "count old samples")
+		}
+		return count, nil
+	}
+
+	res, err := db.Exec(fmt.Sprintf(deleteOldSamplesQuery, monetdb.QuoteIdentifier(name)), cutoff)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return 0, errors.Wrap(err, "delete old samples")
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "rows affected")
+	}
+	return deleted, nil
+}
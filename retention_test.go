@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionOverrides(t *testing.T) {
+	overrides, err := parseRetentionOverrides("up=24h,node_load1=0s,http_requests_total=720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{
+		"up":                  24 * time.Hour,
+		"node_load1":          0,
+		"http_requests_total": 720 * time.Hour,
+	}
+	if len(overrides) != len(expected) {
+		t.Errorf("Invalid overrides: %v, expected: %v", overrides, expected)
+	}
+	for name, retention := range expected {
+		if overrides[name] != retention {
+			t.Errorf("Invalid retention for %s: %s, expected: %s", name, overrides[name], retention)
+		}
+	}
+
+	if overrides, err := parseRetentionOverrides(""); err != nil || len(overrides) != 0 {
+		t.Errorf("Invalid overrides for empty string: %v, %v", overrides, err)
+	}
+
+	for _, invalid := range []string{"up", "=24h", "up=forever", "up=-1h", "up=1h,"} {
+		if _, err := parseRetentionOverrides(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	policy := &retentionPolicy{
+		retention: 24 * time.Hour,
+		overrides: map[string]time.Duration{"up": 0, "node_load1": time.Hour},
+	}
+
+	tcs := map[string]time.Duration{
+		"up":         0,
+		"node_load1": time.Hour,
+		"other":      24 * time.Hour,
+	}
+	for name, expected := range tcs {
+		if retention := policy.metricRetention(name); retention != expected {
+			t.Errorf("Invalid retention for %s: %s, expected: %s", name, retention, expected)
+		}
+	}
+
+	if !policy.enabled() {
+		t.Errorf("Policy with a default retention not enabled")
+	}
+	if (&retentionPolicy{overrides: map[string]time.Duration{"up": 0}}).enabled() {
+		t.Errorf("Policy that keeps everything enabled")
+	}
+	if !(&retentionPolicy{overrides: map[string]time.Duration{"up": time.Hour}}).enabled() {
+		t.Errorf("Policy with an override not enabled")
+	}
+
+	now := time.Unix(7200, 0)
+	if cutoff := retentionCutoff(now, time.Hour); cutoff != 3600000 {
+		t.Errorf("Invalid cutoff: %d, expected: 3600000", cutoff)
+	}
+}
+
+func TestMetricRollupTables(t *testing.T) {
+	existing := map[string]bool{"up": true, "up_rollup_5m": true, "up_rollup_1h": true, "down": true, "down_rollup_5m": true}
+
+	tcs := map[string][]string{
+		"up":    {"up_rollup_5m", "up_rollup_1h"},
+		"down":  {"down_rollup_5m"},
+		"other": {},
+	}
+	for name, e := range tcs {
+		if tables := metricRollupTables(name, existing); !reflect.DeepEqual(tables, e) {
+			t.Errorf("Invalid rollup tables of %s: %v, expected: %v", name, tables, e)
+		}
+	}
+}
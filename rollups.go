@@ -0,0 +1,800 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	//_ "github.com/fajran/go-monetdb"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// rollupResolution is the bucket size of a set of rollup tables
+type rollupResolution struct {
+	name string
+	step time.Duration
+}
+
+// rollup resolutions, finest first
+var rollupResolutions = []rollupResolution{
+	{name: "5m", step: 5 * time.Minute},
+	{name: "1h", step: time.Hour},
+}
+
+var rollupsEnabled bool
+
+// buckets are only rolled up once they're this far in the past, so samples
+// still waiting in the write queue usually make it in. Buckets that get
+// samples after they were rolled up are rolled up again.
+const rollupLag = 2 * time.Minute
+
+// maximum number of buckets rolled up per table in a single run, so a
+// backfill doesn't hold up the other tables
+const maxRollupBuckets = 288
+
+// Prometheus only looks back this far for samples of plain selectors
+const lookbackDelta = 5 * time.Minute
+
+// rollupState is what the rollup job knows about a rollup table, guarded by
+// rollupStatesLock
+type rollupState struct {
+	// start of the first bucket that isn't rolled up yet
+	watermark int64
+	// label columns of the table in the wide layout
+	labels []string
+
+	// end of the buckets being rolled up by the current run
+	running    bool
+	runningEnd int64
+
+	// start of the oldest bucket that got samples after it was rolled up
+	invalid     bool
+	invalidFrom int64
+}
+
+// begin starts a run rolling up the buckets from the watermark up to sealed,
+// but at most span, and returns the range it covers
+func (s *rollupState) begin(sealed int64, span int64) (int64, int64) {
+	s.applyInvalidation()
+
+	start, end := s.watermark, sealed
+	if end > start+span {
+		end = start + span
+	}
+	if end > start {
+		s.running = true
+		s.runningEnd = end
+	}
+	return start, end
+}
+
+// finish ends the current run, moving the watermark to its end if it succeeded
+func (s *rollupState) finish(end int64, succeeded bool) {
+	s.running = false
+	if succeeded {
+		s.watermark = end
+	}
+	s.applyInvalidation()
+}
+
+// invalidate marks a bucket that got samples to be rolled up again if it was
+// rolled up already or is being rolled up
+func (s *rollupState) invalidate(bucket int64) {
+	rolledUp := s.watermark
+	if s.running && s.runningEnd > rolledUp {
+		rolledUp = s.runningEnd
+	}
+	if bucket >= rolledUp {
+		return
+	}
+
+	if !s.invalid || bucket < s.invalidFrom {
+		s.invalid = true
+		s.invalidFrom = bucket
+	}
+}
+
+// applyInvalidation moves the watermark back to the oldest invalid bucket
+func (s *rollupState) applyInvalidation() {
+	if s.invalid && s.invalidFrom < s.watermark {
+		s.watermark = s.invalidFrom
+	}
+	s.invalid = false
+}
+
+// invalidateRollups marks the rolled up buckets that written samples fall into
+// to be rolled up again. tables holds the samples by metric.
+func invalidateRollups(tables map[string]model.Samples) {
+	if !rollupsEnabled {
+		return
+	}
+
+	rollupStatesLock.Lock()
+	defer rollupStatesLock.Unlock()
+
+	for name, samples := range tables {
+		if len(samples) == 0 {
+			continue
+		}
+		oldest := samples[0].Timestamp
+		for _, sample := range samples {
+			if sample.Timestamp < oldest {
+				oldest = sample.Timestamp
+			}
+		}
+
+		for _, res := range rollupResolutions {
+			if state, ok := rollupStates[rollupTableName(name, res)]; ok {
+				state.invalidate(bucketStart(int64(oldest), res.stepMs()))
+			}
+		}
+	}
+}
+
+var rollupStates = map[string]*rollupState{}
+var rollupStatesLock sync.Mutex
+
+var selectMaxTimestampQuery string = `
+SELECT MAX("timestamp") FROM %s;`
+
+var selectMinTimestampQuery string = `
+SELECT MIN("timestamp") FROM %s;`
+
+var selectColumnsQuery string = `
+SELECT columns.name FROM sys.columns, sys.tables WHERE columns.table_id = tables.id AND tables.name = ?;`
+
+var deleteRollupWindowQuery string = `
+DELETE FROM %s WHERE "timestamp" >= ? AND "timestamp" < ?;`
+
+var selectRollupWindowQuery string = `
+SELECT %s FROM %s WHERE "timestamp" >= ? AND "timestamp" < ?;`
+
+// columns of a rollup table apart from its labels or series ID
+var rollupColumns = []string{"timestamp", "min", "max", "sum", "count", "last"}
+
+var rollupTableColumns string = `"timestamp" BIGINT, "min" FLOAT, "max" FLOAT, "sum" FLOAT, "count" BIGINT, "last" FLOAT`
+
+func rollupTableName(name string, res rollupResolution) string {
+	return fmt.Sprintf("%s_rollup_%s", name, res.name)
+}
+
+func (res rollupResolution) stepMs() int64 {
+	return int64(res.step / time.Millisecond)
+}
+
+// startRollups rolls up new samples of every metric every interval until the background is stopped
+func startRollups(bg *background, db *sql.DB, interval time.Duration) {
+	if !rollupsEnabled {
+		return
+	}
+
+	bg.every(interval, func(now time.Time) {
+		err := runRollups(db, now)
+		if err != nil {
+			log.Printf("rollup run failed: %s", err)
+		}
+	})
+}
+
+// runRollups aggregates the complete buckets of every metric that haven't been
+// rolled up yet into the rollup tables of every resolution. A failing table
+// doesn't stop the others from being rolled up.
+func runRollups(db *sql.DB, now time.Time) error {
+	start := time.Now()
+	defer func() {
+		rollupRunDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	tables := currentLabelsMap()
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := []string{}
+	for _, name := range names {
+		for _, res := range rollupResolutions {
+			err := rollupMetric(db, name, res, now)
+			if err != nil {
+				log.Printf("error rolling up table %s: %s", rollupTableName(name, res), err)
+				failed = append(failed, rollupTableName(name, res))
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not roll up tables %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// rollupMetric rolls up the complete buckets of a metric after the watermark
+// of its rollup table at the given resolution.
+func rollupMetric(db *sql.DB, name string, res rollupResolution, now time.Time) error {
+	table := rollupTableName(name, res)
+
+	state, err := getRollupStateOrCreate(db, name, res)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		// no samples to roll up yet
+		return nil
+	}
+
+	step := res.stepMs()
+	sealed := bucketStart(now.Add(-rollupLag).UnixNano()/int64(time.Millisecond), step)
+
+	rollupStatesLock.Lock()
+	start, end := state.begin(sealed, maxRollupBuckets*step)
+	rollupStatesLock.Unlock()
+	if end <= start {
+		return nil
+	}
+
+	inserted, err := rollupWindow(db, name, table, state, step, start, end)
+	rollupStatesLock.Lock()
+	state.finish(end, err == nil)
+	rollupStatesLock.Unlock()
+	if err != nil {
+		return err
+	}
+	rollupRowsInserted.Add(float64(inserted))
+
+	return nil
+}
+
+// rollupWindow replaces the buckets of a rollup table between start and end
+// with the aggregates of the raw samples of the metric
+func rollupWindow(db *sql.DB, name string, table string, state *rollupState, step int64, start int64, end int64) (int64, error) {
+	rollupStatesLock.Lock()
+	labels := state.labels
+	rollupStatesLock.Unlock()
+
+	if storageLayout != layoutSeries {
+		current, err := getLabels(db, name)
+		if err != nil {
+			return 0, err
+		}
+		if len(missingLabels(labels, current)) > 0 {
+			err = addRollupLabels(db, table, labels, current)
+			if err != nil {
+				return 0, err
+			}
+
+			labels = current
+			rollupStatesLock.Lock()
+			state.labels = labels
+			rollupStatesLock.Unlock()
+		}
+	}
+
+	buckets, err := aggregateWindow(db, name, labels, step, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	return copyRollups(db, table, labels, buckets, start, end)
+}
+
+// bucketStart returns the start of the bucket of size step a timestamp falls into
+func bucketStart(timestamp int64, step int64) int64 {
+	start := timestamp - timestamp%step
+	if timestamp < 0 && timestamp%step != 0 {
+		start -= step
+	}
+	return start
+}
+
+// getRollupStateOrCreate returns the state of a rollup table, creating the
+// table if needed. It returns nil if the metric has no samples to roll up.
+func getRollupStateOrCreate(db *sql.DB, name string, res rollupResolution) (*rollupState, error) {
+	table := rollupTableName(name, res)
+
+	rollupStatesLock.Lock()
+	state, exists := rollupStates[table]
+	rollupStatesLock.Unlock()
+	if exists {
+		return state, nil
+	}
+
+	exists, err := tableExists(db, table)
+	if err != nil {
+		return nil, errors.Wrap(err, "rollup table existence")
+	}
+
+	labels := []string{}
+	watermark := sql.NullInt64{}
+	if exists {
+		if storageLayout != layoutSeries {
+			labels, err = getRollupLabels(db, table)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// pick up after the last bucket that was rolled up
+		err = db.QueryRow(fmt.Sprintf(selectMaxTimestampQuery, monetdb.QuoteIdentifier(table))).Scan(&watermark)
+		dbQueries.Inc()
+		if err != nil {
+			queryErrors.Inc()
+			return nil, errors.Wrap(err, "select last rollup")
+		}
+		if watermark.Valid {
+			watermark.Int64 += res.stepMs()
+		}
+	}
+
+	if !watermark.Valid {
+		// start with the bucket of the oldest sample
+		err = db.QueryRow(fmt.Sprintf(selectMinTimestampQuery, monetdb.QuoteIdentifier(name))).Scan(&watermark)
+		dbQueries.Inc()
+		if err != nil {
+			queryErrors.Inc()
+			return nil, errors.Wrap(err, "select first sample")
+		}
+		if !watermark.Valid {
+			return nil, nil
+		}
+		watermark.Int64 = bucketStart(watermark.Int64, res.stepMs())
+	}
+
+	if !exists {
+		if storageLayout != layoutSeries {
+			labels, err = getLabels(db, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = createRollupTable(db, table, labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state = &rollupState{watermark: watermark.Int64, labels: labels}
+	rollupStatesLock.Lock()
+	rollupStates[table] = state
+	rollupStatesLock.Unlock()
+
+	return state, nil
+}
+
+func createRollupTable(db *sql.DB, table string, labels []string) error {
+	tableCreateLock.Lock()
+	defer tableCreateLock.Unlock()
+
+	columns := rollupTableColumns
+	if storageLayout == layoutSeries {
+		columns = `"series_id" BIGINT, ` + columns
+	}
+	for _, label := range labels {
+		columns += fmt.Sprintf(", %s VARCHAR(120)", monetdb.QuoteIdentifier(label))
+	}
+
+	_, err := db.Exec(fmt.Sprintf(createTableQuery, monetdb.QuoteIdentifier(table), columns))
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "create rollup table")
+	}
+	tablesCreated.Inc()
+	log.Printf("created table %s", table)
+
+	return nil
+}
+
+// getRollupLabels returns the label columns of an existing rollup table
+func getRollupLabels(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(selectColumnsQuery, table)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return nil, errors.Wrap(err, "select rollup table columns")
+	}
+	defer rows.Close()
+
+	isRollupColumn := map[string]bool{}
+	for _, column := range rollupColumns {
+		isRollupColumn[column] = true
+	}
+
+	var column string
+	labels := []string{}
+	for rows.Next() {
+		err = rows.Scan(&column)
+		if err != nil {
+			rowScanErrors.Inc()
+			return nil, errors.Wrap(err, "scan rollup table columns")
+		}
+		rowsRead.Inc()
+		if !isRollupColumn[column] {
+			labels = append(labels, column)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return nil, errors.Wrap(err, "rollup table columns row")
+	}
+	return labels, nil
+}
+
+// addRollupLabels adds the labels a metric table gained to its rollup table
+func addRollupLabels(db *sql.DB, table string, current []string, labels []string) error {
+	tableCreateLock.Lock()
+	defer tableCreateLock.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+
+	missing := missingLabels(current, labels)
+	for _, label := range missing {
+		_, err = tx.Exec(fmt.Sprintf(addColumnQuery, monetdb.QuoteIdentifier(table), monetdb.QuoteIdentifier(label)))
+		if err != nil {
+			tx.Rollback()
+			queryErrors.Inc()
+			return errors.Wrapf(err, "add column %s to rollup table", label)
+		}
+	}
+
+	err = tx.Commit()
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transaction")
+	}
+	log.Printf("added labels %s to table %s", strings.Join(missing, ","), table)
+
+	return nil
+}
+
+// rollupBucket aggregates the samples of a series in a bucket
+type rollupBucket struct {
+	// series ID or label values, in column order
+	key       []interface{}
+	timestamp int64
+
+	min, max, sum float64
+	count         int64
+
+	last          float64
+	lastTimestamp int64
+}
+
+func (b *rollupBucket) add(timestamp int64, value float64) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	if b.count == 0 || timestamp >= b.lastTimestamp {
+		b.last = value
+		b.lastTimestamp = timestamp
+	}
+	b.sum += value
+	b.count++
+}
+
+// aggregateWindow aggregates the raw samples of a metric between start and end
+// into buckets of size step
+func aggregateWindow(db *sql.DB, name string, labels []string, step int64, start int64, end int64) ([]*rollupBucket, error) {
+	keyColumns := []string{`"series_id"`}
+	if storageLayout != layoutSeries {
+		keyColumns = make([]string, len(labels))
+		for i, label := range labels {
+			keyColumns[i] = monetdb.QuoteIdentifier(label)
+		}
+	}
+
+	columns := append([]string{`"timestamp"`, `"value"`}, keyColumns...)
+	query := fmt.Sprintf(selectRollupWindowQuery, strings.Join(columns, ", "), monetdb.QuoteIdentifier(name))
+	rows, err := db.Query(query, start, end)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return nil, errors.Wrap(err, "exec rollup window query")
+	}
+	defer rows.Close()
+
+	buckets := map[string]*rollupBucket{}
+	ordered := []*rollupBucket{}
+
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+
+		var (
+			timestamp int64
+			value     float64
+			id        int64
+		)
+		rowScan := []interface{}{&timestamp, &value}
+		if storageLayout == layoutSeries {
+			rowScan = append(rowScan, &id)
+		} else {
+			for _ = range labels {
+				rowScan = append(rowScan, new(sql.NullString))
+			}
+		}
+
+		err = rows.Scan(rowScan...)
+		if err != nil {
+			rowScanErrors.Inc()
+			return nil, errors.Wrap(err, "scan rollup window rows")
+		}
+
+		// labels the series doesn't have stay NULL
+		key := []interface{}{id}
+		if storageLayout != layoutSeries {
+			key = make([]interface{}, len(labels))
+			for i, raw := range rowScan[2:] {
+				if v := raw.(*sql.NullString); v.Valid {
+					key[i] = v.String
+				}
+			}
+		}
+
+		bucket := bucketStart(timestamp, step)
+		bucketKey := fmt.Sprintf("%d%s%v", bucket, labelKeySeparator, key)
+		b, exists := buckets[bucketKey]
+		if !exists {
+			b = &rollupBucket{key: key, timestamp: bucket}
+			buckets[bucketKey] = b
+			ordered = append(ordered, b)
+		}
+		b.add(timestamp, value)
+	}
+
+	rowsRead.Add(float64(rowCount))
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return nil, errors.Wrap(err, "read rollup window rows")
+	}
+
+	return ordered, nil
+}
+
+// copyRollups replaces the rows of a rollup table between start and end with
+// the aggregated buckets, which have been rolled up before if they got late samples
+func copyRollups(db *sql.DB, table string, labels []string, buckets []*rollupBucket, start int64, end int64) (int64, error) {
+	keyColumns := []string{"series_id"}
+	if storageLayout != layoutSeries {
+		keyColumns = labels
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "begin transaction")
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(deleteRollupWindowQuery, monetdb.QuoteIdentifier(table)), start, end)
+	if err != nil {
+		tx.Rollback()
+		queryErrors.Inc()
+		return 0, errors.Wrap(err, "delete previous rollups")
+	}
+
+	inserted := int64(0)
+	if len(buckets) > 0 {
+		inserted, err = copyRollupBuckets(tx, table, append(rollupColumns, keyColumns...), buckets)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return 0, errors.Wrap(err, "commit transaction")
+	}
+
+	return inserted, nil
+}
+
+// copyRollupBuckets bulk loads aggregated buckets into a rollup table
+func copyRollupBuckets(tx *sql.Tx, table string, columns []string, buckets []*rollupBucket) (int64, error) {
+	stmt, err := tx.Prepare(monetdb.CopyIn(len(buckets), table, columns...))
+	if err != nil {
+		return 0, errors.Wrap(err, "prepare copy into")
+	}
+	defer stmt.Close()
+
+	for _, b := range buckets {
+		values := []interface{}{b.timestamp, b.min, b.max, b.sum, b.count, b.last}
+		_, err = stmt.Exec(append(values, b.key...)...)
+		if err != nil {
+			return 0, errors.Wrap(err, "buffer copy into record")
+		}
+	}
+
+	res, err := stmt.Exec()
+	if err != nil {
+		return 0, errors.Wrapf(err, "copy into %s", table)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "rows affected")
+	}
+	return inserted, nil
+}
+
+// rollupValue returns the rollup expression that stands in for the raw samples
+// of a function's argument, or false if the function needs raw samples.
+//
+// Only functions whose result over whole buckets equals their result over the
+// aggregates of the buckets qualify. Averages of averages are weighted wrong,
+// and the rate family needs the first and last samples of its range as well as
+// every counter reset in between, none of which survive a bucket.
+func rollupValue(function string) (string, bool) {
+	switch function {
+	case "max_over_time":
+		return `"max"`, true
+	case "min_over_time":
+		return `"min"`, true
+	case "sum_over_time":
+		return `"sum"`, true
+	case "":
+		// plain selectors only see the last sample before each step
+		return `"last"`, true
+	}
+	return "", false
+}
+
+// selectResolution picks the coarsest rollup resolution that still gives a
+// query at least one sample per step. The hints of the Prometheus version we
+// build against don't carry the range of range vectors, so it's assumed to be
+// at least the step, as with Grafana's $__interval.
+func selectResolution(hints *prompb.ReadHints) (*rollupResolution, string) {
+	if !rollupsEnabled || hints == nil || hints.StepMs <= 0 {
+		return nil, ""
+	}
+
+	value, ok := rollupValue(hints.Func)
+	if !ok {
+		return nil, ""
+	}
+
+	for i := len(rollupResolutions) - 1; i >= 0; i-- {
+		res := rollupResolutions[i]
+		if hints.StepMs < res.stepMs() {
+			continue
+		}
+		// plain selectors only see samples within the lookback delta
+		if hints.Func == "" && res.step > lookbackDelta {
+			continue
+		}
+		return &res, value
+	}
+	return nil, ""
+}
+
+// readResolution reads the timeseries matching a query from a metric at the
+// coarsest resolution its hints allow. Rollups serve the part of the query
+// range that has been rolled up, raw samples the rest.
+func readResolution(ctx context.Context, db *sql.DB, q *prompb.Query, name string) ([]*prompb.TimeSeries, error) {
+	res, value := selectResolution(q.Hints)
+	if res == nil {
+		return readRaw(ctx, db, q, name)
+	}
+
+	rollupStatesLock.Lock()
+	state, exists := rollupStates[rollupTableName(name, *res)]
+	var watermark int64
+	var labels []string
+	if exists {
+		watermark = state.watermark
+		labels = state.labels
+	}
+	rollupStatesLock.Unlock()
+
+	// rollups are deleted along with the raw samples, so they aren't read past the retention either
+	cutoff := int64(math.MinInt64)
+	if retention := currentSettings().retention.metricRetention(name); retention > 0 {
+		cutoff = retentionCutoff(time.Now(), retention)
+	}
+
+	start, end, ok := rollupRange(q, watermark, cutoff)
+	if !exists || !ok {
+		return readRaw(ctx, db, q, name)
+	}
+
+	// aggregates are complete at the end of their bucket, so that's where their samples go
+	src := metricSource{
+		table:  rollupTableName(name, *res),
+		value:  value,
+		offset: res.stepMs() - 1,
+	}
+
+	rollupQuery := *q
+	rollupQuery.StartTimestampMs = start
+	rollupQuery.EndTimestampMs = end
+
+	var rolledUp []*prompb.TimeSeries
+	var err error
+	if storageLayout == layoutSeries {
+		rolledUp, err = readSeriesMetric(ctx, db, &rollupQuery, name, src)
+	} else {
+		rolledUp, err = readMetric(ctx, db, &rollupQuery, name, labels, src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rollupReads.WithLabelValues(res.name).Inc()
+
+	if q.EndTimestampMs < watermark {
+		return rolledUp, nil
+	}
+
+	rawQuery := *q
+	rawQuery.StartTimestampMs = watermark
+	raw, err := readRaw(ctx, db, &rawQuery, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeTimeseries(rolledUp, raw), nil
+}
+
+// rollupRange returns the part of a query's range served from rollups, which
+// ends before the watermark and doesn't start before the retention cutoff, or
+// false if there's no such part
+func rollupRange(q *prompb.Query, watermark int64, cutoff int64) (int64, int64, bool) {
+	start, end := q.StartTimestampMs, q.EndTimestampMs
+	if start < cutoff {
+		start = cutoff
+	}
+	if end >= watermark {
+		end = watermark - 1
+	}
+	return start, end, start < watermark && start <= end
+}
+
+// mergeTimeseries appends the samples of timeseries in b to those with the same
+// labels in a, which must be older.
+func mergeTimeseries(a []*prompb.TimeSeries, b []*prompb.TimeSeries) []*prompb.TimeSeries {
+	bySignature := make(map[string]*prompb.TimeSeries, len(a))
+	for _, ts := range a {
+		bySignature[labelsSignature(ts.Labels)] = ts
+	}
+
+	for _, ts := range b {
+		existing, ok := bySignature[labelsSignature(ts.Labels)]
+		if !ok {
+			a = append(a, ts)
+			continue
+		}
+		existing.Samples = append(existing.Samples, ts.Samples...)
+	}
+	return a
+}
+
+func labelsSignature(labels []*prompb.Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.Name + labelKeySeparator + l.Value
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, labelKeySeparator)
+}
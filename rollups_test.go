@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRollupBucket(t *testing.T) {
+	b := &rollupBucket{}
+	b.add(20, 3)
+	b.add(10, 5)
+	b.add(30, -1)
+	b.add(25, 2)
+
+	if b.min != -1 || b.max != 5 || b.sum != 9 || b.count != 4 {
+		t.Errorf("Invalid aggregates: min %v, max %v, sum %v, count %d", b.min, b.max, b.sum, b.count)
+	}
+	if b.last != -1 || b.lastTimestamp != 30 {
+		t.Errorf("Invalid last sample: %v at %d, expected: -1 at 30", b.last, b.lastTimestamp)
+	}
+}
+
+func TestRollupStateInvalidation(t *testing.T) {
+	s := &rollupState{watermark: 100}
+
+	// buckets that aren't rolled up yet don't need to be rolled up again
+	s.invalidate(100)
+	start, end := s.begin(500, 1000)
+	if start != 100 || end != 500 {
+		t.Errorf("Invalid run: %d to %d, expected: 100 to 500", start, end)
+	}
+
+	// samples written during a run may have missed it
+	s.invalidate(300)
+	s.invalidate(600)
+	s.finish(end, true)
+	if s.watermark != 300 {
+		t.Errorf("Invalid watermark: %d, expected: 300", s.watermark)
+	}
+
+	start, end = s.begin(500, 1000)
+	if start != 300 || end != 500 {
+		t.Errorf("Invalid run: %d to %d, expected: 300 to 500", start, end)
+	}
+	s.finish(end, true)
+
+	// late samples roll up their bucket and everything after it again
+	s.invalidate(200)
+	s.invalidate(400)
+	start, end = s.begin(600, 1000)
+	if start != 200 || end != 600 {
+		t.Errorf("Invalid run: %d to %d, expected: 200 to 600", start, end)
+	}
+
+	// a failed run leaves the watermark where it was
+	s.finish(end, false)
+	if s.watermark != 200 {
+		t.Errorf("Invalid watermark after failed run: %d, expected: 200", s.watermark)
+	}
+
+	// runs are limited to span
+	start, end = s.begin(10000, 1000)
+	if start != 200 || end != 1200 {
+		t.Errorf("Invalid run: %d to %d, expected: 200 to 1200", start, end)
+	}
+}
+
+func TestSelectResolution(t *testing.T) {
+	rollupsEnabled = true
+	defer func() { rollupsEnabled = false }()
+
+	minute := int64(60 * 1000)
+	tcs := []struct {
+		hints      *prompb.ReadHints
+		resolution string
+		value      string
+	}{
+		{nil, "", ""},
+		{&prompb.ReadHints{Func: "rate"}, "", ""},
+		{&prompb.ReadHints{StepMs: minute, Func: "rate"}, "", ""},
+		{&prompb.ReadHints{StepMs: 5 * minute, Func: "max_over_time"}, "5m", `"max"`},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "max_over_time"}, "1h", `"max"`},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "min_over_time"}, "1h", `"min"`},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "sum_over_time"}, "1h", `"sum"`},
+		// these need raw samples
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "rate"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "irate"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "increase"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "delta"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "idelta"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "avg_over_time"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "count_over_time"}, "", ""},
+		{&prompb.ReadHints{StepMs: 60 * minute, Func: "quantile_over_time"}, "", ""},
+		// plain selectors can't see further back than the lookback delta
+		{&prompb.ReadHints{StepMs: 60 * minute}, "5m", `"last"`},
+	}
+
+	for _, tc := range tcs {
+		res, value := selectResolution(tc.hints)
+		resolution := ""
+		if res != nil {
+			resolution = res.name
+		}
+		if resolution != tc.resolution || value != tc.value {
+			t.Errorf("Invalid resolution for %+v: %q %s, expected: %q %s", tc.hints, resolution, value, tc.resolution, tc.value)
+		}
+	}
+
+	rollupsEnabled = false
+	if res, _ := selectResolution(&prompb.ReadHints{StepMs: 60 * minute, Func: "max_over_time"}); res != nil {
+		t.Errorf("Resolution selected with rollups disabled: %s", res.name)
+	}
+}
+
+func TestMergeTimeseries(t *testing.T) {
+	api := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	db := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+	apiReordered := []*prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}}
+
+	merged := mergeTimeseries(
+		[]*prompb.TimeSeries{{Labels: api, Samples: []*prompb.Sample{{Timestamp: 1}}}},
+		[]*prompb.TimeSeries{
+			{Labels: apiReordered, Samples: []*prompb.Sample{{Timestamp: 2}}},
+			{Labels: db, Samples: []*prompb.Sample{{Timestamp: 2}}},
+		},
+	)
+
+	if len(merged) != 2 {
+		t.Fatalf("Invalid number of timeseries: %d, expected: 2", len(merged))
+	}
+	if len(merged[0].Samples) != 2 || merged[0].Samples[0].Timestamp != 1 || merged[0].Samples[1].Timestamp != 2 {
+		t.Errorf("Invalid merged samples: %v", merged[0].Samples)
+	}
+	if len(merged[1].Samples) != 1 {
+		t.Errorf("Invalid samples for new timeseries: %v", merged[1].Samples)
+	}
+}
+
+func TestRollupRange(t *testing.T) {
+	tcs := []struct {
+		start, end int64
+		watermark  int64
+		cutoff     int64
+		eStart     int64
+		eEnd       int64
+		ok         bool
+	}{
+		// rolled up up to the watermark, the rest is raw
+		{1000, 5000, 3000, math.MinInt64, 1000, 2999, true},
+		{1000, 2000, 3000, math.MinInt64, 1000, 2000, true},
+		{3000, 5000, 3000, math.MinInt64, 0, 0, false},
+		// nothing past the retention is read from rollups
+		{1000, 5000, 3000, 2000, 2000, 2999, true},
+		{1000, 5000, 3000, 4000, 0, 0, false},
+		{1000, 1500, 3000, 2000, 0, 0, false},
+	}
+
+	for _, tc := range tcs {
+		q := &prompb.Query{StartTimestampMs: tc.start, EndTimestampMs: tc.end}
+		start, end, ok := rollupRange(q, tc.watermark, tc.cutoff)
+		if ok != tc.ok || (ok && (start != tc.eStart || end != tc.eEnd)) {
+			t.Errorf("Invalid rollup range of %d-%d with watermark %d and cutoff %d: %d-%d %v, expected: %d-%d %v", tc.start, tc.end, tc.watermark, tc.cutoff, start, end, ok, tc.eStart, tc.eEnd, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	//_ "github.com/fajran/go-monetdb"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// storage layouts
+const (
+	// every metric table has a column per label, repeated on every row
+	layoutWide = "wide"
+	// label sets live in the series table, metric tables only store series IDs
+	layoutSeries = "series"
+)
+
+var storageLayout = layoutWide
+
+// series we know to be in the series table, so writes only insert new ones
+var knownSeries = map[model.Fingerprint]bool{}
+var knownSeriesLock sync.Mutex
+
+// decoded label sets by series ID. A series' labels never change, so they're
+// only fetched and decoded the first time the series is read.
+var seriesLabels = map[int64]map[string]string{}
+var seriesLabelsLock sync.Mutex
+
+// maximum number of series in each of the series caches. A full cache is
+// cleared, so a series written again afterwards is inserted again, which
+// reads ignore.
+var maxCachedSeries = 1000000
+
+// writes hold seriesPruneLock for reading from checking whether their series
+// are known until their samples commit, so retention doesn't delete a series
+// that's about to get samples
+var seriesPruneLock sync.RWMutex
+
+// maximum number of series IDs to look up in a single query
+const maxSeriesPerQuery = 1000
+
+// series table
+var seriesTableName string = "prometheus_adapter_series"
+
+var createSeriesTableQuery string = `
+CREATE TABLE "prometheus_adapter_series" ("series_id" BIGINT, "metric" VARCHAR(120), "labels" CLOB);`
+
+var selectSeriesIDsQuery string = `
+SELECT series_id FROM prometheus_adapter_series WHERE metric = ?;`
+
+var selectSeriesLabelsQuery string = `
+SELECT series_id, labels FROM prometheus_adapter_series WHERE series_id IN (%s);`
+
+var selectAllSeriesIDsQuery string = `
+SELECT series_id FROM prometheus_adapter_series;`
+
+var selectOrphanSeriesQuery string = `
+SELECT DISTINCT series_id FROM prometheus_adapter_series WHERE metric = ? AND series_id NOT IN (SELECT "series_id" FROM %s);`
+
+var deleteOrphanSeriesQuery string = `
+DELETE FROM prometheus_adapter_series WHERE metric = ? AND series_id NOT IN (SELECT "series_id" FROM %s);`
+
+// metric tables in the series layout
+var seriesMetricTableColumns string = `"series_id" BIGINT, "timestamp" BIGINT, "value" FLOAT`
+
+var selectSeriesSamplesQuery string = `
+SELECT "series_id", %s, %s FROM %s WHERE "series_id" IN (%s) AND "timestamp" >= ? AND "timestamp" <= ?%s;`
+
+func validLayout(layout string) bool {
+	return layout == layoutWide || layout == layoutSeries
+}
+
+// initSeries creates the series table if needed and loads the IDs of the series it holds
+func initSeries(db *sql.DB) error {
+	exists, err := tableExists(db, seriesTableName)
+	if err != nil {
+		return errors.Wrap(err, "series table existence")
+	}
+	if !exists {
+		err = createSeriesTable(db)
+		if err != nil {
+			return errors.Wrap(err, "create series table")
+		}
+	}
+
+	rows, err := db.Query(selectAllSeriesIDsQuery)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "select all series ids query")
+	}
+	defer rows.Close()
+
+	knownSeriesLock.Lock()
+	defer knownSeriesLock.Unlock()
+
+	var id int64
+	for rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			rowScanErrors.Inc()
+			return errors.Wrap(err, "scan series rows")
+		}
+		rowsRead.Inc()
+
+		// the rest are inserted again when they're written
+		if len(knownSeries) >= maxCachedSeries {
+			break
+		}
+		knownSeries[model.Fingerprint(id)] = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return errors.Wrap(err, "series row")
+	}
+
+	return nil
+}
+
+func createSeriesTable(db *sql.DB) error {
+	tableCreateLock.Lock()
+	defer tableCreateLock.Unlock()
+
+	_, err := db.Exec(createSeriesTableQuery)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "create series table")
+	}
+
+	tablesCreated.Inc()
+	return nil
+}
+
+// unknownSeries returns the series of the samples that aren't known to be in
+// the series table, which need to be inserted along with the samples.
+// Concurrent writes may both insert a new series, which reads ignore.
+func unknownSeries(samples model.Samples) map[model.Fingerprint]model.Metric {
+	knownSeriesLock.Lock()
+	defer knownSeriesLock.Unlock()
+
+	newSeries := map[model.Fingerprint]model.Metric{}
+	for _, sample := range samples {
+		fp := sample.Metric.Fingerprint()
+		if !knownSeries[fp] {
+			newSeries[fp] = sample.Metric
+		}
+	}
+	return newSeries
+}
+
+// registerSeries marks series as known once the transaction inserting them
+// committed, so no write references a series whose insert was rolled back
+func registerSeries(series map[model.Fingerprint]model.Metric) {
+	knownSeriesLock.Lock()
+	defer knownSeriesLock.Unlock()
+
+	if len(knownSeries)+len(series) > maxCachedSeries {
+		knownSeries = map[model.Fingerprint]bool{}
+	}
+	for fp := range series {
+		knownSeries[fp] = true
+	}
+}
+
+// forgetSeries removes series deleted from the series table from the caches
+func forgetSeries(ids []int64) {
+	knownSeriesLock.Lock()
+	for _, id := range ids {
+		delete(knownSeries, model.Fingerprint(id))
+	}
+	knownSeriesLock.Unlock()
+
+	seriesLabelsLock.Lock()
+	for _, id := range ids {
+		delete(seriesLabels, id)
+	}
+	seriesLabelsLock.Unlock()
+}
+
+// pruneSeries deletes the series of a metric without samples left from the
+// series table and returns how many there were, only counting them when
+// dryRun is set
+func pruneSeries(db *sql.DB, name string, dryRun bool) (int64, error) {
+	seriesPruneLock.Lock()
+	defer seriesPruneLock.Unlock()
+
+	rows, err := db.Query(fmt.Sprintf(selectOrphanSeriesQuery, monetdb.QuoteIdentifier(name)), name)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return 0, errors.Wrap(err, "select orphan series query")
+	}
+	defer rows.Close()
+
+	var id int64
+	ids := []int64{}
+	for rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			rowScanErrors.Inc()
+			return 0, errors.Wrap(err, "scan orphan series rows")
+		}
+		ids = append(ids, id)
+	}
+	rowsRead.Add(float64(len(ids)))
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return 0, errors.Wrap(err, "orphan series row")
+	}
+
+	if dryRun || len(ids) == 0 {
+		return int64(len(ids)), nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf(deleteOrphanSeriesQuery, monetdb.QuoteIdentifier(name)), name)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return 0, errors.Wrap(err, "delete orphan series")
+	}
+	forgetSeries(ids)
+
+	return int64(len(ids)), nil
+}
+
+// writeSeriesSamples writes samples grouped by metric table in the series
+// layout, inserting the series that aren't in the series table yet in the
+// same transaction.
+func writeSeriesSamples(ctx context.Context, db *sql.DB, tables map[string]model.Samples) error {
+	tableTargets := make(map[string]map[string]model.Samples, len(tables))
+	for name, tableSamples := range tables {
+		_, err := getLabelsOrCreate(db, name, []string{})
+		if err != nil {
+			return err
+		}
+
+		targets, err := copyTargets(db, name, tableSamples)
+		if err != nil {
+			return err
+		}
+		tableTargets[name] = targets
+	}
+
+	seriesPruneLock.RLock()
+	defer seriesPruneLock.RUnlock()
+
+	newSeries := map[model.Fingerprint]model.Metric{}
+	for _, tableSamples := range tables {
+		for fp, metric := range unknownSeries(tableSamples) {
+			newSeries[fp] = metric
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+
+	if len(newSeries) > 0 {
+		err = copySeries(ctx, tx, newSeries)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	inserts := int64(len(newSeries))
+	for _, targets := range tableTargets {
+		for target, targetSamples := range targets {
+			inserted, err := copySeriesSamples(ctx, tx, target, targetSamples)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			inserts += inserted
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transacton")
+	}
+	dbQueries.Inc()
+	rowsInserted.Add(float64(inserts))
+	registerSeries(newSeries)
+
+	// samples for buckets that are rolled up already have to be rolled up again
+	invalidateRollups(tables)
+
+	return nil
+}
+
+// copySeries bulk loads new series into the series table
+func copySeries(ctx context.Context, tx *sql.Tx, series map[model.Fingerprint]model.Metric) error {
+	stmt, err := tx.PrepareContext(ctx, monetdb.CopyIn(len(series), seriesTableName, "series_id", "metric", "labels"))
+	if err != nil {
+		return errors.Wrap(err, "prepare copy into")
+	}
+	defer stmt.Close()
+
+	for fp, metric := range series {
+		encoded, err := encodeSeriesLabels(metric)
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(int64(fp), string(metric[model.MetricNameLabel]), encoded)
+		if err != nil {
+			return errors.Wrap(err, "buffer copy into record")
+		}
+	}
+
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "copy into series table")
+	}
+	return nil
+}
+
+// copySeriesSamples bulk loads samples into a metric table of the series layout
+func copySeriesSamples(ctx context.Context, tx *sql.Tx, name string, samples model.Samples) (int64, error) {
+	stmt, err := tx.PrepareContext(ctx, monetdb.CopyIn(len(samples), name, "series_id", "timestamp", "value"))
+	if err != nil {
+		return 0, errors.Wrap(err, "prepare copy into")
+	}
+	defer stmt.Close()
+
+	for _, sample := range samples {
+		_, err = stmt.Exec(int64(sample.Metric.Fingerprint()), int64(sample.Timestamp), float64(sample.Value))
+		if err != nil {
+			return 0, errors.Wrap(err, "buffer copy into record")
+		}
+	}
+
+	res, err := stmt.ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "copy into %s", name)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "rows affected")
+	}
+	return inserted, nil
+}
+
+// readSeriesMetric reads the timeseries matching a query from a single metric
+// table of the series layout. The matchers are resolved against the label sets
+// in the series table first, then the samples are fetched by series ID.
+func readSeriesMetric(ctx context.Context, db *sql.DB, q *prompb.Query, name string, src metricSource) ([]*prompb.TimeSeries, error) {
+	series, err := matchingSeries(ctx, db, q, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return []*prompb.TimeSeries{}, nil
+	}
+
+	ids := make([]int64, 0, len(series))
+	for id := range series {
+		ids = append(ids, id)
+	}
+
+	for start := 0; start < len(ids); start += maxSeriesPerQuery {
+		end := start + maxSeriesPerQuery
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		err = scanSeriesSamples(ctx, db, q, src, ids[start:end], false, func(id int64, timestamp int64, value float64) error {
+			ts := series[id]
+			ts.Samples = append(ts.Samples, &prompb.Sample{
+				Timestamp: timestamp,
+				Value:     value,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	promTimeseries := make([]*prompb.TimeSeries, 0, len(series))
+	for _, ts := range series {
+		if len(ts.Samples) > 0 {
+			promTimeseries = append(promTimeseries, ts)
+		}
+	}
+	return promTimeseries, nil
+}
+
+// encodeSeriesLabels encodes the labels of a series apart from its metric
+// name for the series table
+func encodeSeriesLabels(metric model.Metric) (string, error) {
+	labels := make(map[string]string, len(metric))
+	for k, v := range metric {
+		if k != model.MetricNameLabel {
+			labels[string(k)] = string(v)
+		}
+	}
+
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return "", errors.Wrap(err, "encode series labels")
+	}
+	return string(encoded), nil
+}
+
+func decodeSeriesLabels(encoded string) (map[string]string, error) {
+	labels := map[string]string{}
+	err := json.Unmarshal([]byte(encoded), &labels)
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// matchingSeries returns the series of a metric whose labels match the query,
+// keyed by series ID.
+func matchingSeries(ctx context.Context, db *sql.DB, q *prompb.Query, name string) (map[int64]*prompb.TimeSeries, error) {
+	ids, err := metricSeriesIDs(ctx, db, name)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := lookupSeriesLabels(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return matchSeries(q, name, labels)
+}
+
+// metricSeriesIDs returns the IDs of the series of a metric
+func metricSeriesIDs(ctx context.Context, db *sql.DB, name string) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, selectSeriesIDsQuery, name)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return nil, errors.Wrap(err, "select series ids query")
+	}
+	defer rows.Close()
+
+	var id int64
+	ids := []int64{}
+	for rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			rowScanErrors.Inc()
+			return nil, errors.Wrap(err, "scan series id rows")
+		}
+		ids = append(ids, id)
+	}
+
+	rowsRead.Add(float64(len(ids)))
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return nil, errors.Wrap(err, "series id row")
+	}
+	return ids, nil
+}
+
+// lookupSeriesLabels returns the labels of the given series by ID, fetching
+// the ones that haven't been read before from the series table
+func lookupSeriesLabels(ctx context.Context, db *sql.DB, ids []int64) (map[int64]map[string]string, error) {
+	labels := make(map[int64]map[string]string, len(ids))
+	missing := []int64{}
+
+	seriesLabelsLock.Lock()
+	for _, id := range ids {
+		if l, ok := seriesLabels[id]; ok {
+			labels[id] = l
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	seriesLabelsLock.Unlock()
+
+	for start := 0; start < len(missing); start += maxSeriesPerQuery {
+		end := start + maxSeriesPerQuery
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		fetched, err := fetchSeriesLabels(ctx, db, missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		seriesLabelsLock.Lock()
+		if len(seriesLabels)+len(fetched) > maxCachedSeries {
+			seriesLabels = map[int64]map[string]string{}
+		}
+		for id, l := range fetched {
+			seriesLabels[id] = l
+			labels[id] = l
+		}
+		seriesLabelsLock.Unlock()
+	}
+
+	return labels, nil
+}
+
+// fetchSeriesLabels reads and decodes the labels of the given series
+func fetchSeriesLabels(ctx context.Context, db *sql.DB, ids []int64) (map[int64]map[string]string, error) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(selectSeriesLabelsQuery, strings.Join(placeholders, ", ")), args...)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return nil, errors.Wrap(err, "select series labels query")
+	}
+	defer rows.Close()
+
+	var (
+		id      int64
+		encoded string
+	)
+
+	labels := make(map[int64]map[string]string, len(ids))
+	for rows.Next() {
+		err = rows.Scan(&id, &encoded)
+		if err != nil {
+			rowScanErrors.Inc()
+			return nil, errors.Wrap(err, "scan series rows")
+		}
+		rowsRead.Inc()
+
+		// a series inserted by concurrent writes has identical rows
+		if _, ok := labels[id]; ok {
+			continue
+		}
+		labels[id], err = decodeSeriesLabels(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode labels of series %d", id)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return nil, errors.Wrap(err, "series row")
+	}
+
+	return labels, nil
+}
+
+// matchSeries returns the timeseries of the series of a metric whose labels
+// match the query, keyed by series ID
+func matchSeries(q *prompb.Query, name string, series map[int64]map[string]string) (map[int64]*prompb.TimeSeries, error) {
+	matches := []func(string) bool{}
+	matchLabels := []string{}
+	for _, m := range q.Matchers {
+		if m.Name == model.MetricNameLabel || m.Name == "remote_read" {
+			continue
+		}
+		match, err := labelMatchFunc(m)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+		matchLabels = append(matchLabels, m.Name)
+	}
+
+	matched := map[int64]*prompb.TimeSeries{}
+	for id, labels := range series {
+		ok := true
+		for i, match := range matches {
+			if !match(labels[matchLabels[i]]) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		labelPairs := []*prompb.Label{
+			&prompb.Label{
+				Name:  model.MetricNameLabel,
+				Value: name,
+			},
+		}
+		for k, v := range labels {
+			if v == "" {
+				continue
+			}
+			labelPairs = append(labelPairs, &prompb.Label{
+				Name:  k,
+				Value: v,
+			})
+		}
+		matched[id] = &prompb.TimeSeries{Labels: labelPairs}
+	}
+
+	return matched, nil
+}
+
+// scanSeriesSamples calls fn with the series ID, timestamp and value of every
+// row of the given series IDs within the query range, oldest first. When ordered
+// is set, the rows of each series come one after another in the order of ids.
+func scanSeriesSamples(ctx context.Context, db *sql.DB, q *prompb.Query, src metricSource, ids []int64, ordered bool, fn func(int64, int64, float64) error) error {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, 0, len(ids)+2)
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	args = append(args, q.StartTimestampMs-src.offset, q.EndTimestampMs-src.offset)
+
+	timestamp := `"timestamp"`
+	value := src.value
+	var clauses strings.Builder
+
+	// let MonetDB aggregate the samples of each step if that doesn't change the result
+	if aggregate, ok := pushdownAggregate(q.Hints); ok {
+		bucket := pushdownBucket(q, src)
+		timestamp = fmt.Sprintf("MAX(%s)", bucket)
+		value = fmt.Sprintf("%s(%s)", aggregate, src.value)
+		clauses.WriteString(fmt.Sprintf(` GROUP BY "series_id", %s`, bucket))
+	}
+
+	// batches of a table are flushed concurrently and may commit in any order
+	if ordered {
+		cases := make([]string, len(ids))
+		for i, id := range ids {
+			cases[i] = fmt.Sprintf("WHEN %d THEN %d", id, i)
+		}
+		clauses.WriteString(fmt.Sprintf(` ORDER BY CASE "series_id" %s END, %s`, strings.Join(cases, " "), timestamp))
+	} else {
+		clauses.WriteString(" ORDER BY " + timestamp)
+	}
+
+	query := fmt.Sprintf(selectSeriesSamplesQuery, timestamp, value, monetdb.QuoteIdentifier(src.table), strings.Join(placeholders, ", "), clauses.String())
+	rows, err := db.QueryContext(ctx, query, args...)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "exec read series samples query")
+	}
+	defer rows.Close()
+
+	var (
+		id       int64
+		rowTime  int64
+		rowValue float64
+	)
+
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+
+		err = rows.Scan(&id, &rowTime, &rowValue)
+		if err != nil {
+			rowScanErrors.Inc()
+			return errors.Wrap(err, "scan series sample rows")
+		}
+
+		err = fn(id, rowTime+src.offset, rowValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	rowsRead.Add(float64(rowCount))
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return errors.Wrap(err, "read series sample rows")
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRegisterSeries(t *testing.T) {
+	knownSeries = map[model.Fingerprint]bool{}
+
+	up := model.Metric{model.MetricNameLabel: "up", "job": "api"}
+	down := model.Metric{model.MetricNameLabel: "up", "job": "db"}
+	samples := model.Samples{
+		&model.Sample{Metric: up, Timestamp: 1},
+		&model.Sample{Metric: up, Timestamp: 2},
+		&model.Sample{Metric: down, Timestamp: 1},
+	}
+
+	newSeries := unknownSeries(samples)
+	if len(newSeries) != 2 {
+		t.Fatalf("Invalid number of new series: %d, expected: 2", len(newSeries))
+	}
+	if !newSeries[up.Fingerprint()].Equal(up) {
+		t.Errorf("Invalid series for %s: %s", up.Fingerprint(), newSeries[up.Fingerprint()])
+	}
+
+	// series stay unknown until the transaction inserting them commits
+	if again := unknownSeries(samples); len(again) != 2 {
+		t.Errorf("Invalid number of new series before registering: %d, expected: 2", len(again))
+	}
+
+	registerSeries(newSeries)
+	if again := unknownSeries(samples); len(again) != 0 {
+		t.Errorf("Known series new again: %v", again)
+	}
+}
+
+func TestSeriesLabelsRoundTrip(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "api", "instance": "a:80", "quote": `"\`}
+
+	encoded, err := encodeSeriesLabels(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := decodeSeriesLabels(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched, err := matchSeries(&prompb.Query{}, "up", map[int64]map[string]string{1: labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := model.Metric{}
+	for _, l := range matched[1].Labels {
+		decoded[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	if !decoded.Equal(metric) {
+		t.Errorf("Invalid labels after round trip: %s, expected: %s", decoded, metric)
+	}
+}
+
+func TestMatchSeries(t *testing.T) {
+	series := map[int64]map[string]string{
+		1: {"job": "api", "env": "prod"},
+		2: {"job": "api", "env": "staging"},
+		3: {"job": "db"},
+		4: {"job": "db", "env": ""},
+	}
+
+	tcs := []struct {
+		matchers []*prompb.LabelMatcher
+		ids      []int64
+	}{
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: "up"}},
+			[]int64{1, 2, 3, 4},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"}},
+			[]int64{1, 2},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_NEQ, Name: "env", Value: "prod"}},
+			[]int64{2, 3, 4},
+		},
+		{
+			// a missing label is the same as an empty one
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "env", Value: ""}},
+			[]int64{3, 4},
+		},
+		{
+			[]*prompb.LabelMatcher{
+				{Type: prompb.LabelMatcher_RE, Name: "env", Value: "prod|stag.*"},
+				{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "a"},
+			},
+			[]int64{1, 2},
+		},
+		{
+			[]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "remote_read", Value: "true"}},
+			[]int64{1, 2, 3, 4},
+		},
+	}
+
+	for _, tc := range tcs {
+		matched, err := matchSeries(&prompb.Query{Matchers: tc.matchers}, "up", series)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matched) != len(tc.ids) {
+			t.Errorf("Invalid number of series matching %v: %d, expected: %d", tc.matchers, len(matched), len(tc.ids))
+		}
+		for _, id := range tc.ids {
+			if _, ok := matched[id]; !ok {
+				t.Errorf("Series %d doesn't match %v", id, tc.matchers)
+			}
+		}
+	}
+
+	// empty labels are left out of the timeseries
+	matched, err := matchSeries(&prompb.Query{}, "up", series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels := matched[4].Labels; len(labels) != 2 {
+		t.Errorf("Invalid labels of series 4: %v", labels)
+	}
+}
+
+func TestSeriesCaches(t *testing.T) {
+	defer func(max int) { maxCachedSeries = max }(maxCachedSeries)
+	maxCachedSeries = 2
+	knownSeries = map[model.Fingerprint]bool{}
+
+	a := model.Metric{model.MetricNameLabel: "up", "job": "a"}
+	b := model.Metric{model.MetricNameLabel: "up", "job": "b"}
+	c := model.Metric{model.MetricNameLabel: "up", "job": "c"}
+
+	registerSeries(map[model.Fingerprint]model.Metric{a.Fingerprint(): a, b.Fingerprint(): b})
+	if len(knownSeries) != 2 {
+		t.Fatalf("Invalid number of known series: %d, expected: 2", len(knownSeries))
+	}
+
+	// a full cache is cleared rather than growing past its limit
+	registerSeries(map[model.Fingerprint]model.Metric{c.Fingerprint(): c})
+	if len(knownSeries) != 1 || !knownSeries[c.Fingerprint()] {
+		t.Errorf("Invalid known series after overflow: %v", knownSeries)
+	}
+
+	// pruned series have to be inserted again when they get new samples
+	seriesLabels = map[int64]map[string]string{int64(c.Fingerprint()): {"job": "c"}}
+	forgetSeries([]int64{int64(c.Fingerprint())})
+	if len(knownSeries) != 0 || len(seriesLabels) != 0 {
+		t.Errorf("Series still cached after forgetting them: %v, %v", knownSeries, seriesLabels)
+	}
+	if newSeries := unknownSeries(model.Samples{{Metric: c}}); len(newSeries) != 1 {
+		t.Errorf("Invalid number of new series after forgetting them: %d, expected: 1", len(newSeries))
+	}
+}
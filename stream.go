@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	//_ "github.com/fajran/go-monetdb"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remote read response types, the prompb we build against predates them
+const (
+	responseTypeSamples             = 0
+	responseTypeStreamedXORChunks   = 1
+	readRequestAcceptedTypesField   = 2
+	streamedReadResponseContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+)
+
+// chunk encodings
+const chunkEncodingXOR = 1
+
+// frames are flushed once their chunks get this big, the same limit Prometheus uses
+const maxFrameBytes = 1024 * 1024
+
+// maximum number of series whose samples are streamed by a single query
+const maxStreamedSeriesPerQuery = 100
+
+var selectDistinctSeriesQuery string = `
+SELECT DISTINCT %s FROM %s WHERE %s;`
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// acceptsStreamedChunks decodes the accepted_response_types of a marshalled
+// ReadRequest and reports whether the client prefers streamed XOR chunks,
+// which it does if they come before the samples type.
+func acceptsStreamedChunks(reqBuf []byte) (bool, error) {
+	for len(reqBuf) > 0 {
+		key, n := binary.Uvarint(reqBuf)
+		if n <= 0 {
+			return false, errors.New("invalid read request field key")
+		}
+		reqBuf = reqBuf[n:]
+
+		field, wireType := key>>3, key&7
+		types := []uint64{}
+		switch wireType {
+		case proto.WireVarint:
+			v, n := binary.Uvarint(reqBuf)
+			if n <= 0 {
+				return false, errors.New("invalid read request varint")
+			}
+			reqBuf = reqBuf[n:]
+			types = append(types, v)
+		case proto.WireFixed64, proto.WireFixed32:
+			size := 8
+			if wireType == proto.WireFixed32 {
+				size = 4
+			}
+			if len(reqBuf) < size {
+				return false, errors.New("truncated read request")
+			}
+			reqBuf = reqBuf[size:]
+		case proto.WireBytes:
+			size, n := binary.Uvarint(reqBuf)
+			if n <= 0 || uint64(len(reqBuf)-n) < size {
+				return false, errors.New("truncated read request")
+			}
+			raw := reqBuf[n : n+int(size)]
+			reqBuf = reqBuf[n+int(size):]
+
+			// accepted types are a packed repeated enum
+			for field == readRequestAcceptedTypesField && len(raw) > 0 {
+				v, n := binary.Uvarint(raw)
+				if n <= 0 {
+					return false, errors.New("invalid accepted response types")
+				}
+				raw = raw[n:]
+				types = append(types, v)
+			}
+		default:
+			return false, errors.Errorf("unsupported wire type %d in read request", wireType)
+		}
+
+		if field != readRequestAcceptedTypesField {
+			continue
+		}
+		for _, t := range types {
+			switch t {
+			case responseTypeStreamedXORChunks:
+				return true, nil
+			case responseTypeSamples:
+				return false, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// chunkedWriter writes length-delimited, checksummed frames of a streamed
+// remote read response.
+type chunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	// whether any frame has been written, after which errors can't be reported to the client
+	written bool
+}
+
+func newChunkedWriter(w io.Writer) *chunkedWriter {
+	flusher, _ := w.(http.Flusher)
+	return &chunkedWriter{w: w, flusher: flusher}
+}
+
+// writeFrame writes a marshalled ChunkedReadResponse as a single frame
+func (c *chunkedWriter) writeFrame(msg []byte) error {
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(msg)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(msg, castagnoliTable))
+
+	c.written = true
+	_, err := c.w.Write(header[:n+4])
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return nil
+}
+
+// encodedChunk is a finished chunk of a series
+type encodedChunk struct {
+	minTime int64
+	maxTime int64
+	data    []byte
+}
+
+// seriesStreamer encodes the samples of one series at a time into XOR chunks
+// and writes them out as frames, so only a frame's worth of a series is ever
+// held in memory. Samples must be appended oldest first.
+type seriesStreamer struct {
+	w          *chunkedWriter
+	queryIndex int64
+
+	labels []*prompb.Label
+	chunks []encodedChunk
+	size   int
+	chunk  *xorChunk
+}
+
+func newSeriesStreamer(w *chunkedWriter, queryIndex int64) *seriesStreamer {
+	return &seriesStreamer{w: w, queryIndex: queryIndex}
+}
+
+// startSeries finishes the current series and starts a new one with the given labels
+func (s *seriesStreamer) startSeries(labels []*prompb.Label) error {
+	err := s.finishSeries()
+	if err != nil {
+		return err
+	}
+
+	// clients expect the labels of a series to be sorted
+	s.labels = sortLabels(labels)
+	s.chunk = newXORChunk()
+	return nil
+}
+
+func (s *seriesStreamer) append(t int64, v float64) error {
+	if s.chunk.numSamples() >= maxChunkSamples {
+		err := s.cutChunk()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.chunk.append(t, v)
+	return nil
+}
+
+// cutChunk finishes the current chunk, writing out a frame if it's full
+func (s *seriesStreamer) cutChunk() error {
+	if s.chunk == nil || s.chunk.numSamples() == 0 {
+		return nil
+	}
+
+	s.chunks = append(s.chunks, encodedChunk{
+		minTime: s.chunk.minTime,
+		maxTime: s.chunk.maxTime,
+		data:    s.chunk.bytes(),
+	})
+	s.size += len(s.chunk.bytes())
+	s.chunk = newXORChunk()
+
+	if s.size >= maxFrameBytes {
+		return s.flush()
+	}
+	return nil
+}
+
+// finishSeries writes out the rest of the current series
+func (s *seriesStreamer) finishSeries() error {
+	err := s.cutChunk()
+	if err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// flush writes the finished chunks of the current series as a frame
+func (s *seriesStreamer) flush() error {
+	if len(s.chunks) == 0 {
+		return nil
+	}
+
+	msg := marshalChunkedReadResponse(s.labels, s.chunks, s.queryIndex)
+	s.chunks = s.chunks[:0]
+	s.size = 0
+	return s.w.writeFrame(msg)
+}
+
+// marshalChunkedReadResponse marshals a ChunkedReadResponse holding a single series
+func marshalChunkedReadResponse(labels []*prompb.Label, chunks []encodedChunk, queryIndex int64) []byte {
+	series := proto.NewBuffer(nil)
+	for _, l := range labels {
+		label := proto.NewBuffer(nil)
+		label.EncodeVarint(1<<3 | proto.WireBytes)
+		label.EncodeStringBytes(l.Name)
+		label.EncodeVarint(2<<3 | proto.WireBytes)
+		label.EncodeStringBytes(l.Value)
+
+		series.EncodeVarint(1<<3 | proto.WireBytes)
+		series.EncodeRawBytes(label.Bytes())
+	}
+	for _, c := range chunks {
+		chunk := proto.NewBuffer(nil)
+		chunk.EncodeVarint(1<<3 | proto.WireVarint)
+		chunk.EncodeVarint(uint64(c.minTime))
+		chunk.EncodeVarint(2<<3 | proto.WireVarint)
+		chunk.EncodeVarint(uint64(c.maxTime))
+		chunk.EncodeVarint(3<<3 | proto.WireVarint)
+		chunk.EncodeVarint(chunkEncodingXOR)
+		chunk.EncodeVarint(4<<3 | proto.WireBytes)
+		chunk.EncodeRawBytes(c.data)
+
+		series.EncodeVarint(2<<3 | proto.WireBytes)
+		series.EncodeRawBytes(chunk.Bytes())
+	}
+
+	resp := proto.NewBuffer(nil)
+	resp.EncodeVarint(1<<3 | proto.WireBytes)
+	resp.EncodeRawBytes(series.Bytes())
+	if queryIndex != 0 {
+		resp.EncodeVarint(2<<3 | proto.WireVarint)
+		resp.EncodeVarint(uint64(queryIndex))
+	}
+
+	return resp.Bytes()
+}
+
+// streamReadRequest writes the timeseries matching a read request as frames of
+// XOR chunks. Rollups aren't used as they would split series across queries.
+// Each query gets timeout to finish.
+func streamReadRequest(ctx context.Context, db *sql.DB, req *prompb.ReadRequest, cw *chunkedWriter, timeout time.Duration) error {
+	for i, q := range req.Queries {
+		err := streamQuery(ctx, db, q, int64(i), cw, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// streamedSeries is a timeseries matching a streamed query
+type streamedSeries struct {
+	name string
+	// sorted labels
+	labels []*prompb.Label
+
+	// series ID in the series layout
+	id int64
+	// label columns of the metric table and their values in the wide layout
+	columns     []string
+	labelValues []string
+}
+
+// streamQuery streams the timeseries matching a single query of a read
+// request. Clients merge the series of a streamed response the way TSDB emits
+// them, sorted by their labels, so the matching series are found and sorted
+// first, then their samples are read a few series at a time in that order.
+func streamQuery(ctx context.Context, db *sql.DB, q *prompb.Query, index int64, cw *chunkedWriter, timeout time.Duration) error {
+	ctx, cancel := timeoutContext(ctx, timeout)
+	defer cancel()
+
+	// figure out the metric names (and thus the tables) the query touches
+	names, err := getQueryMetricNames(q)
+	if err != nil {
+		return err
+	}
+
+	series := []*streamedSeries{}
+	for _, name := range names {
+		var found []*streamedSeries
+		if storageLayout == layoutSeries {
+			found, err = seriesStreamedSeries(ctx, db, q, name)
+		} else {
+			found, err = metricStreamedSeries(ctx, db, q, name)
+		}
+		if err != nil {
+			return err
+		}
+		series = append(series, found...)
+	}
+	sort.Slice(series, func(i, j int) bool { return compareLabels(series[i].labels, series[j].labels) < 0 })
+
+	s := newSeriesStreamer(cw, index)
+	for start := 0; start < len(series); {
+		// each query reads consecutive series of a single metric table
+		end := start + 1
+		for end < len(series) && end-start < maxStreamedSeriesPerQuery && series[end].name == series[start].name {
+			end++
+		}
+
+		if storageLayout == layoutSeries {
+			err = streamSeriesSamples(ctx, db, q, series[start:end], s)
+		} else {
+			err = streamMetricSamples(ctx, db, q, series[start:end], s)
+		}
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return s.finishSeries()
+}
+
+// metricStreamedSeries returns the timeseries of a metric table with a column
+// per label that have samples matching a query
+func metricStreamedSeries(ctx context.Context, db *sql.DB, q *prompb.Query, name string) ([]*streamedSeries, error) {
+	labels, err := getLabels(db, name)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args, filters, err := buildWhere(q, rawSource(name), labels)
+	if err != nil {
+		return nil, errors.Wrap(err, "build read query")
+	}
+	filterColumns := labelFilterColumns(filters, labels)
+
+	// a metric without labels has a single timeseries
+	columns := "1"
+	if len(labels) > 0 {
+		quoted := make([]string, len(labels))
+		for i, label := range labels {
+			quoted[i] = monetdb.QuoteIdentifier(label)
+		}
+		columns = strings.Join(quoted, ", ")
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(selectDistinctSeriesQuery, columns, monetdb.QuoteIdentifier(name), where), args...)
+	dbQueries.Inc()
+	if err != nil {
+		queryErrors.Inc()
+		return nil, errors.Wrap(err, "exec read series query")
+	}
+	defer rows.Close()
+
+	series := []*streamedSeries{}
+	seen := map[string]bool{}
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+
+		rowScan := []interface{}{}
+		if len(labels) == 0 {
+			rowScan = append(rowScan, new(int64))
+		}
+		for _ = range labels {
+			rowScan = append(rowScan, new(sql.NullString))
+		}
+
+		err = rows.Scan(rowScan...)
+		if err != nil {
+			rowScanErrors.Inc()
+			return nil, errors.Wrap(err, "scan series rows")
+		}
+
+		labelValues := make([]string, len(labels))
+		for i := range labelValues {
+			labelValues[i] = rowScan[i].(*sql.NullString).String
+		}
+
+		// NULL and empty label values are the same timeseries
+		key := strings.Join(labelValues, labelKeySeparator)
+		if seen[key] || !matchesFilters(filters, filterColumns, labelValues) {
+			continue
+		}
+		seen[key] = true
+
+		series = append(series, &streamedSeries{
+			name:        name,
+			labels:      sortLabels(metricLabels(name, labels, labelValues)),
+			columns:     labels,
+			labelValues: labelValues,
+		})
+	}
+
+	rowsRead.Add(float64(rowCount))
+
+	err = rows.Err()
+	if err != nil {
+		rowErrors.Inc()
+		return nil, errors.Wrap(err, "read series rows")
+	}
+
+	return series, nil
+}
+
+// streamMetricSamples streams the samples of timeseries of a single metric
+// table with a column per label in the order of series
+func streamMetricSamples(ctx context.Context, db *sql.DB, q *prompb.Query, series []*streamedSeries, s *seriesStreamer) error {
+	labelValues := make([][]string, len(series))
+	byKey := make(map[string]*streamedSeries, len(series))
+	for i, ss := range series {
+		labelValues[i] = ss.labelValues
+		byKey[strings.Join(ss.labelValues, labelKeySeparator)] = ss
+	}
+
+	currentKey := ""
+	started := false
+	return scanMetric(ctx, db, q, series[0].columns, rawSource(series[0].name), labelValues, func(values []string, timestamp int64, value float64) error {
+		key := strings.Join(values, labelKeySeparator)
+		if !started || key != currentKey {
+			ss, ok := byKey[key]
+			if !ok {
+				return errors.Errorf("unexpected series %q of metric %s", values, series[0].name)
+			}
+			err := s.startSeries(ss.labels)
+			if err != nil {
+				return err
+			}
+			currentKey = key
+			started = true
+		}
+		return s.append(timestamp, value)
+	})
+}
+
+// seriesStreamedSeries returns the series of a metric table of the series
+// layout whose labels match a query
+func seriesStreamedSeries(ctx context.Context, db *sql.DB, q *prompb.Query, name string) ([]*streamedSeries, error) {
+	matched, err := matchingSeries(ctx, db, q, name)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]*streamedSeries, 0, len(matched))
+	for id, ts := range matched {
+		series = append(series, &streamedSeries{
+			name:   name,
+			labels: sortLabels(ts.Labels),
+			id:     id,
+		})
+	}
+	return series, nil
+}
+
+// streamSeriesSamples streams the samples of series of a single metric table
+// of the series layout in the order of series
+func streamSeriesSamples(ctx context.Context, db *sql.DB, q *prompb.Query, series []*streamedSeries, s *seriesStreamer) error {
+	ids := make([]int64, len(series))
+	byID := make(map[int64]*streamedSeries, len(series))
+	for i, ss := range series {
+		ids[i] = ss.id
+		byID[ss.id] = ss
+	}
+
+	currentID := int64(0)
+	started := false
+	return scanSeriesSamples(ctx, db, q, rawSource(series[0].name), ids, true, func(id int64, timestamp int64, value float64) error {
+		if !started || id != currentID {
+			err := s.startSeries(byID[id].labels)
+			if err != nil {
+				return err
+			}
+			currentID = id
+			started = true
+		}
+		return s.append(timestamp, value)
+	})
+}
+
+// sortLabels returns a copy of labels sorted by name
+func sortLabels(labels []*prompb.Label) []*prompb.Label {
+	sorted := make([]*prompb.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// compareLabels compares two sorted label sets the way Prometheus orders series
+func compareLabels(a, b []*prompb.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestAcceptsStreamedChunks(t *testing.T) {
+	query, err := proto.Marshal(&prompb.Query{StartTimestampMs: 1, EndTimestampMs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := append([]byte{1<<3 | proto.WireBytes, byte(len(query))}, query...)
+
+	tcs := []struct {
+		name     string
+		req      []byte
+		streamed bool
+	}{
+		{"no types", queries, false},
+		{"packed streamed", append(queries, 2<<3|proto.WireBytes, 1, responseTypeStreamedXORChunks), true},
+		{"packed samples first", append(queries, 2<<3|proto.WireBytes, 2, responseTypeSamples, responseTypeStreamedXORChunks), false},
+		{"packed streamed first", append(queries, 2<<3|proto.WireBytes, 2, responseTypeStreamedXORChunks, responseTypeSamples), true},
+		{"unpacked streamed", append(queries, 2<<3|proto.WireVarint, responseTypeStreamedXORChunks), true},
+		{"unknown type", append(queries, 2<<3|proto.WireBytes, 1, 42), false},
+	}
+
+	for _, tc := range tcs {
+		streamed, err := acceptsStreamedChunks(tc.req)
+		if err != nil {
+			t.Errorf("Error decoding %s: %v", tc.name, err)
+			continue
+		}
+		if streamed != tc.streamed {
+			t.Errorf("Invalid result for %s: %v, expected: %v", tc.name, streamed, tc.streamed)
+		}
+	}
+
+	if _, err := acceptsStreamedChunks(append(queries, 2<<3|proto.WireBytes, 5, 1)); err == nil {
+		t.Errorf("Expected an error for a truncated request")
+	}
+}
+
+// readFrames splits a streamed response into its messages, checking the checksums
+func readFrames(t *testing.T, b []byte) [][]byte {
+	frames := [][]byte{}
+	for len(b) > 0 {
+		size, n := binary.Uvarint(b)
+		if n <= 0 || len(b) < n+4+int(size) {
+			t.Fatalf("Invalid frame header")
+		}
+		checksum := binary.BigEndian.Uint32(b[n:])
+		msg := b[n+4 : n+4+int(size)]
+		if crc32.Checksum(msg, castagnoliTable) != checksum {
+			t.Errorf("Invalid frame checksum")
+		}
+		frames = append(frames, msg)
+		b = b[n+4+int(size):]
+	}
+	return frames
+}
+
+func TestSeriesStreamer(t *testing.T) {
+	var buf bytes.Buffer
+	s := newSeriesStreamer(newChunkedWriter(&buf), 3)
+
+	err := s.startSeries([]*prompb.Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*maxChunkSamples+1; i++ {
+		if err := s.append(int64(i*1000), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.startSeries([]*prompb.Label{{Name: "__name__", Value: "up"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.append(0, 1)
+
+	// a series without samples doesn't get a frame
+	err = s.startSeries([]*prompb.Label{{Name: "__name__", Value: "down"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.finishSeries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := readFrames(t, buf.Bytes())
+	if len(frames) != 2 {
+		t.Fatalf("Invalid number of frames: %d, expected: 2", len(frames))
+	}
+
+	// the labels are sorted and the query index comes last
+	first := frames[0]
+	if !bytes.Contains(first, []byte("__name__")) || bytes.Index(first, []byte("__name__")) > bytes.Index(first, []byte("job")) {
+		t.Errorf("Labels missing or unsorted in %x", first)
+	}
+	if !bytes.HasSuffix(first, []byte{2<<3 | proto.WireVarint, 3}) {
+		t.Errorf("Invalid query index in %x", first)
+	}
+
+	// three chunks of 120, 120 and 1 samples
+	if n := bytes.Count(first, []byte{3<<3 | proto.WireVarint, chunkEncodingXOR, 4<<3 | proto.WireBytes}); n != 3 {
+		t.Errorf("Invalid number of chunks: %d, expected: 3", n)
+	}
+}
+
+func TestCompareLabels(t *testing.T) {
+	label := func(pairs ...string) []*prompb.Label {
+		labels := []*prompb.Label{}
+		for i := 0; i < len(pairs); i += 2 {
+			labels = append(labels, &prompb.Label{Name: pairs[i], Value: pairs[i+1]})
+		}
+		return labels
+	}
+
+	// the order Prometheus sorts series in
+	e := [][]*prompb.Label{
+		label("__name__", "down"),
+		label("__name__", "up"),
+		label("__name__", "up", "instance", "b"),
+		label("__name__", "up", "job", "api"),
+		label("__name__", "up", "job", "api", "zone", "a"),
+		label("__name__", "up", "job", "db"),
+	}
+
+	series := make([][]*prompb.Label, len(e))
+	for i := range e {
+		series[i] = e[len(e)-1-i]
+	}
+	sort.Slice(series, func(i, j int) bool { return compareLabels(series[i], series[j]) < 0 })
+
+	for i := range e {
+		if compareLabels(series[i], e[i]) != 0 {
+			t.Errorf("Invalid series at %d: %v, expected: %v", i, series[i], e[i])
+		}
+	}
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
-	"strings"
+	"regexp"
 
 	//_ "github.com/fajran/go-monetdb"
-	_ "github.internal.digitalocean.com/observability/monet/driver"
+	monetdb "github.internal.digitalocean.com/observability/monet/driver"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
@@ -21,7 +21,7 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-func initWrite(db *sql.DB) {
+func initWrite(mux *http.ServeMux, queue *writeQueue) {
 	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -45,10 +45,11 @@ func initWrite(db *sql.DB) {
 		}
 
 		samples := protoToSamples(&req)
-		err = writeSamples(db, samples)
+		err = queue.enqueue(samples)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("HTTP Error %v on /write, cause: %s", http.StatusInternalServerError, err)
+			// a 5xx makes Prometheus back off and retry the request later
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			log.Printf("HTTP Error %v on /write, cause: %s", http.StatusServiceUnavailable, err)
 			return
 		}
 	})
@@ -61,37 +62,43 @@ func initWrite(db *sql.DB) {
 		),
 	)
 
-	http.Handle("/write", writeChain)
+	mux.Handle("/write", writeChain)
 }
 
 // protoToSamples converts the proto objects to Prometheus objects
 func protoToSamples(req *prompb.WriteRequest) model.Samples {
+	s := currentSettings()
+
 	var samples model.Samples
 	for _, ts := range req.Timeseries {
+		labels := relabel(ts.Labels, s.relabelRules)
+		if labels == nil {
+			continue
+		}
+
 		// prepare a labelMap with all the labels
-		metric := make(model.Metric, len(ts.Labels))
+		metric := make(model.Metric, len(labels))
 		// insert the labels/values
-		for _, l := range ts.Labels {
+		for _, l := range labels {
 			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
 		}
 
 		// build the corpus of samples we'll be inserting
 		name, hasName := metric[model.MetricNameLabel]
-		_, inLabelsMap := labelsMap[string(name)]
-		_, inWhitelist := metricWhitelist[string(name)]
+		_, inLabelsMap := currentLabelsMap()[string(name)]
+		inWhitelist := s.whitelist.matches(string(name))
 
-		// TODO: remove HasPrefix bit
-		if hasName && (inLabelsMap || inWhitelist || strings.HasPrefix(string(name), "monetdb")) {
-			for _, s := range ts.Samples {
+		if hasName && (inLabelsMap || inWhitelist) {
+			for _, sample := range ts.Samples {
 				// skip NaN values. TODO: use 0?
-				if math.IsNaN(s.Value) {
+				if math.IsNaN(sample.Value) {
 					continue
 				}
 
 				samples = append(samples, &model.Sample{
 					Metric:    metric,
-					Value:     model.SampleValue(s.Value),
-					Timestamp: model.Time(s.Timestamp),
+					Value:     model.SampleValue(sample.Value),
+					Timestamp: model.Time(sample.Timestamp),
 				})
 			}
 		}
@@ -99,66 +106,159 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 	return samples
 }
 
-func writeSamples(db *sql.DB, samples model.Samples) error {
-	statements := []string{}
+func writeSamples(ctx context.Context, db *sql.DB, samples model.Samples) error {
+	// group the samples by the metric table they'll be copied into
+	tables := map[string]model.Samples{}
 	for _, sample := range samples {
-		// figure out metric name
-		var name string
-		metric := sample.Metric
-		if metName, hasName := metric[model.MetricNameLabel]; !hasName {
-			continue
-		} else {
-			name = string(metName)
+		if name, hasName := sample.Metric[model.MetricNameLabel]; hasName {
+			tables[string(name)] = append(tables[string(name)], sample)
 		}
+	}
 
-		// get labels from database or create a table if it doesn't exist
-		labels, err := getLabelsOrCreate(db, name, metric)
+	if len(tables) == 0 {
+		return nil
+	}
+
+	if storageLayout == layoutSeries {
+		return writeSeriesSamples(ctx, db, tables)
+	}
+
+	// get labels from database, creating tables, columns or partitions that don't exist yet
+	tableLabels := make(map[string][]string, len(tables))
+	tableTargets := make(map[string]map[string]model.Samples, len(tables))
+	for name, tableSamples := range tables {
+		labels, err := getLabelsOrCreate(db, name, sampleLabelNames(tableSamples))
 		if err != nil {
 			return err
 		}
+		tableLabels[name] = labels
 
-		// build the query
-		var metricLabelValues strings.Builder
-		metricLabelValues.WriteString(fmt.Sprintf("%d ,", sample.Timestamp))
-		metricLabelValues.WriteString(fmt.Sprintf(" %f", sample.Value))
-		for _, label := range labels {
-			metricLabelValues.WriteString(fmt.Sprintf(", '%s'", string(metric[model.LabelName(label)])))
+		targets, err := copyTargets(db, name, tableSamples)
+		if err != nil {
+			return err
 		}
-
-		statements = append(statements, fmt.Sprintf(insertMetricQuery, name, metricLabelValues.String()))
+		tableTargets[name] = targets
 	}
 
-	if len(statements) > 0 {
-		tx, err := db.Begin()
-		if err != nil {
-			return errors.Wrap(err, "begin transaction")
-		}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
 
-		inserts := int64(0)
-		for _, stmt := range statements {
-			res, err := tx.Exec(stmt)
+	inserts := int64(0)
+	for name, targets := range tableTargets {
+		for target, targetSamples := range targets {
+			inserted, err := copySamples(ctx, tx, target, tableLabels[name], targetSamples)
 			if err != nil {
 				tx.Rollback()
-				return errors.Wrap(err, "exec insert in transaction")
+				return err
 			}
+			inserts += inserted
+		}
+	}
 
-			inserted, err := res.RowsAffected()
-			if err != nil {
-				// TODO: delete me
-				log.Printf("error reading number of rows affected: %s", err)
+	err = tx.Commit()
+	if err != nil {
+		queryErrors.Inc()
+		return errors.Wrap(err, "commit transacton")
+	}
+	dbQueries.Inc()
+	rowsInserted.Add(float64(inserts))
+
+	// samples for buckets that are rolled up already have to be rolled up again
+	invalidateRollups(tables)
+
+	return nil
+}
+
+// copySamples bulk loads samples into a metric table with COPY INTO
+func copySamples(ctx context.Context, tx *sql.Tx, name string, labels []string, samples model.Samples) (int64, error) {
+	columns := append([]string{"timestamp", "value"}, labels...)
+	stmt, err := tx.PrepareContext(ctx, monetdb.CopyIn(len(samples), name, columns...))
+	if err != nil {
+		return 0, errors.Wrap(err, "prepare copy into")
+	}
+	defer stmt.Close()
+
+	for _, sample := range samples {
+		values := make([]interface{}, 0, len(columns))
+		values = append(values, int64(sample.Timestamp), float64(sample.Value))
+		for _, label := range labels {
+			// labels the series doesn't have are stored as NULL
+			if value, ok := sample.Metric[model.LabelName(label)]; ok {
+				values = append(values, string(value))
+			} else {
+				values = append(values, nil)
 			}
+		}
 
-			inserts += inserted
+		_, err = stmt.Exec(values...)
+		if err != nil {
+			return 0, errors.Wrap(err, "buffer copy into record")
 		}
+	}
+
+	res, err := stmt.ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "copy into %s", name)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		// TODO: delete me
+		log.Printf("error reading number of rows affected: %s", err)
+	}
+
+	return inserted, nil
+}
+
+// metricWhitelist matches the names of metrics that are ingested even though
+// they don't have a table yet. Entries are either names or anchored regexes.
+type metricWhitelist struct {
+	names    map[string]bool
+	patterns []*regexp.Regexp
+}
 
-		err = tx.Commit()
+func newMetricWhitelist(entries []string) (*metricWhitelist, error) {
+	w := &metricWhitelist{names: map[string]bool{}}
+	for _, entry := range entries {
+		if regexp.QuoteMeta(entry) == entry {
+			w.names[entry] = true
+			continue
+		}
+
+		re, err := compileAnchored(entry)
 		if err != nil {
-			queryErrors.Inc()
-			return errors.Wrap(err, "commit transacton")
+			return nil, errors.Wrapf(err, "invalid whitelist regex %q", entry)
 		}
-		dbQueries.Inc()
-		rowsInserted.Add(float64(inserts))
+		w.patterns = append(w.patterns, re)
 	}
+	return w, nil
+}
 
-	return nil
+func (w *metricWhitelist) matches(name string) bool {
+	if w.names[name] {
+		return true
+	}
+	for _, re := range w.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleLabelNames returns the names of all labels used by the samples, apart from the metric name
+func sampleLabelNames(samples model.Samples) []string {
+	seen := map[model.LabelName]bool{}
+	labels := []string{}
+	for _, sample := range samples {
+		for k := range sample.Metric {
+			if k != model.MetricNameLabel && !seen[k] {
+				seen[k] = true
+				labels = append(labels, string(k))
+			}
+		}
+	}
+	return labels
 }